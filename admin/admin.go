@@ -0,0 +1,115 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"polybalance/backend"
+	"time"
+)
+
+// admin.go exposes operator controls over live backends (add/remove/update, draining) under /api/admin/
+type API struct {
+	pool                *backend.BackendPool
+	newBackend          backend.Factory
+	defaultDrainTimeout time.Duration
+}
+
+func NewAPI(pool *backend.BackendPool, factory backend.Factory, defaultDrainTimeout time.Duration) *API {
+	if defaultDrainTimeout <= 0 {
+		defaultDrainTimeout = 30 * time.Second
+	}
+	return &API{
+		pool:                pool,
+		newBackend:          factory,
+		defaultDrainTimeout: defaultDrainTimeout,
+	}
+}
+
+func (a *API) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/api/admin/backends", a.handleBackends)
+	mux.HandleFunc("/api/admin/backends/drain", a.handleDrain)
+}
+
+// findBackend looks a backend up by its URL, ignoring a trailing slash
+func (a *API) findBackend(rawURL string) *backend.Backend {
+	return a.pool.Get(rawURL)
+}
+
+// handleDrain manages the drain state of one backend, selected by ?url=
+//
+//	GET    - report drain progress
+//	POST   - start draining; ?timeout=30s sets the drain deadline, ?wait=true blocks
+//	         until active connections reach zero or the deadline passes
+//	DELETE - stop draining and put the backend back into rotation
+func (a *API) handleDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodPost, http.MethodDelete:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	b := a.findBackend(r.URL.Query().Get("url"))
+	if b == nil {
+		writeError(w, http.StatusNotFound, "Unknown backend URL")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPost:
+		timeout := a.defaultDrainTimeout
+		if v := r.URL.Query().Get("timeout"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				writeError(w, http.StatusBadRequest, "Invalid timeout: "+v)
+				return
+			}
+			timeout = d
+		}
+
+		b.StartDrain(timeout)
+
+		if r.URL.Query().Get("wait") == "true" {
+			waitForDrain(r, b)
+		}
+
+	case http.MethodDelete:
+		b.StopDrain()
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "ok",
+		"backend": b.URL.String(),
+		"drain":   b.GetDrainStatus(),
+	})
+}
+
+// waitForDrain polls until the backend has no active connections, its drain
+// deadline passes, draining is cancelled or the client goes away
+func waitForDrain(r *http.Request, b *backend.Backend) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		st := b.GetDrainStatus()
+		if !st.Draining || st.Drained || st.TimedOut {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "error",
+		"message": msg,
+	})
+}
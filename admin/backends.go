@@ -0,0 +1,220 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"polybalance/backend"
+	"polybalance/events"
+	"time"
+)
+
+// backendRequest is the JSON body accepted when adding or updating a backend.
+// Pointer fields distinguish "not provided" from zero values on update.
+type backendRequest struct {
+	URL    string            `json:"url"`
+	Weight *int              `json:"weight"`
+	Labels map[string]string `json:"labels"`
+}
+
+// backendView is how a backend is reported by the admin API
+type backendView struct {
+	URL         string              `json:"url"`
+	Weight      int                 `json:"weight"`
+	Labels      map[string]string   `json:"labels"`
+	Healthy     bool                `json:"healthy"`
+	Circuit     string              `json:"circuit"`
+	Connections int64               `json:"connections"`
+	Tunnels     int64               `json:"tunnels"`
+	LatencyMs   int64               `json:"avg_latency_ms"`
+	Drain       backend.DrainStatus `json:"drain"`
+}
+
+func viewOf(b *backend.Backend) backendView {
+	return backendView{
+		URL:         b.URL.String(),
+		Weight:      b.GetWeight(),
+		Labels:      b.GetLabels(),
+		Healthy:     b.IsAlive(),
+		Circuit:     b.GetCircuitState().String(),
+		Connections: b.GetActiveConnections(),
+		Tunnels:     b.GetActiveTunnels(),
+		LatencyMs:   b.GetAverageLatency().Milliseconds(),
+		Drain:       b.GetDrainStatus(),
+	}
+}
+
+// handleBackends manages pool membership
+//
+//	GET    - list backends
+//	POST   - add a backend: {"url": "...", "weight": 1, "labels": {...}}
+//	PUT    - update the backend selected by ?url= (any of url, weight, labels)
+//	DELETE - remove the backend selected by ?url=; with ?drain=true it is drained
+//	         first (bounded by ?timeout=) and removed in the background
+func (a *API) handleBackends(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		snapshot := a.pool.Snapshot()
+		views := make([]backendView, 0, len(snapshot))
+		for _, b := range snapshot {
+			views = append(views, viewOf(b))
+		}
+		json.NewEncoder(w).Encode(views)
+
+	case http.MethodPost:
+		var req backendRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid JSON body: "+err.Error())
+			return
+		}
+		if req.URL == "" {
+			writeError(w, http.StatusBadRequest, "Backend URL required")
+			return
+		}
+		weight := 1
+		if req.Weight != nil {
+			weight = *req.Weight
+		}
+		if weight < 0 {
+			writeError(w, http.StatusBadRequest, "Weight must not be negative")
+			return
+		}
+
+		b, err := a.newBackend(req.URL, weight)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		b.SetLabels(req.Labels)
+		b.Origin = backend.OriginAdmin
+
+		if err := a.pool.Add(b); err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		writeBackend(w, b)
+
+	case http.MethodPut:
+		a.updateBackend(w, r)
+
+	case http.MethodDelete:
+		a.removeBackend(w, r)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *API) updateBackend(w http.ResponseWriter, r *http.Request) {
+	b := a.findBackend(r.URL.Query().Get("url"))
+	if b == nil {
+		writeError(w, http.StatusNotFound, "Unknown backend URL")
+		return
+	}
+
+	var req backendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body: "+err.Error())
+		return
+	}
+	if req.Weight != nil && *req.Weight < 0 {
+		writeError(w, http.StatusBadRequest, "Weight must not be negative")
+		return
+	}
+
+	// a new URL needs a new proxy, so build a replacement and swap it in
+	if req.URL != "" && req.URL != b.URL.String() {
+		weight := b.GetWeight()
+		if req.Weight != nil {
+			weight = *req.Weight
+		}
+		repl, err := a.newBackend(req.URL, weight)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		labels := b.GetLabels()
+		if req.Labels != nil {
+			labels = req.Labels
+		}
+		repl.SetLabels(labels)
+		repl.Origin = backend.OriginAdmin
+		if req.Weight != nil || b.WeightOverridden() {
+			repl.OverrideWeight(weight)
+		}
+
+		if err := a.pool.Replace(b, repl); err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeBackend(w, repl)
+		return
+	}
+
+	if req.Weight != nil {
+		b.OverrideWeight(*req.Weight)
+	}
+	if req.Labels != nil {
+		b.SetLabels(req.Labels)
+	}
+	if req.Weight != nil || req.Labels != nil {
+		events.Publish(events.BackendUpdated, b.URL.String(), fmt.Sprintf("backend updated, weight %d", b.GetWeight()))
+	}
+	writeBackend(w, b)
+}
+
+func (a *API) removeBackend(w http.ResponseWriter, r *http.Request) {
+	rawURL := r.URL.Query().Get("url")
+	b := a.findBackend(rawURL)
+	if b == nil {
+		writeError(w, http.StatusNotFound, "Unknown backend URL")
+		return
+	}
+
+	if r.URL.Query().Get("drain") != "true" {
+		if _, err := a.pool.Remove(rawURL); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeBackend(w, b)
+		return
+	}
+
+	timeout := a.defaultDrainTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "Invalid timeout: "+v)
+			return
+		}
+		timeout = d
+	}
+
+	b.StartDrain(timeout)
+	go func() {
+		deadline := time.Now().Add(timeout)
+		for b.GetActiveConnections() > 0 && time.Now().Before(deadline) && b.IsDraining() {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if !b.IsDraining() {
+			return // drain was cancelled, keep the backend
+		}
+		if err := a.pool.RemoveBackend(b); err != nil {
+			log.Printf("[admin] Removing drained backend %s failed: %v", b.URL.String(), err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+	writeBackend(w, b)
+}
+
+func writeBackend(w http.ResponseWriter, b *backend.Backend) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "ok",
+		"backend": viewOf(b),
+	})
+}
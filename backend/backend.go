@@ -1,8 +1,10 @@
 package backend
 
 import (
+        "fmt"
         "net/http/httputil"
         "net/url"
+        "polybalance/events"
         "sync"
         "time"
 )
@@ -16,14 +18,55 @@ const (
         CircuitHalfOpen
 )
 
+// Origin records what put a backend into the pool
+type Origin string
+
+const (
+        OriginConfig    Origin = "config"    // LB_BACKENDS at startup
+        OriginAdmin     Origin = "admin"     // added at runtime through the admin API
+        OriginDiscovery Origin = "discovery" // owned by a service discovery reconciler
+)
+
+func (c CircuitState) String() string {
+        switch c {
+        case CircuitOpen:
+                return "open"
+        case CircuitHalfOpen:
+                return "half_open"
+        default:
+                return "closed"
+        }
+}
+
+// ParseCircuitState is the inverse of CircuitState.String
+func ParseCircuitState(s string) (CircuitState, error) {
+        switch s {
+        case "closed", "":
+                return CircuitClosed, nil
+        case "open":
+                return CircuitOpen, nil
+        case "half_open":
+                return CircuitHalfOpen, nil
+        default:
+                return CircuitClosed, fmt.Errorf("unknown circuit state %q", s)
+        }
+}
+
 // Backend holds data and runtime state for a single upstream server
 type Backend struct {
         URL    *url.URL
         Proxy  *httputil.ReverseProxy
         Weight int
+        // set once before the backend is added to the pool; empty means OriginConfig
+        Origin Origin
 
         mu sync.RWMutex
 
+        // arbitrary key/value metadata (version, zone, ...)
+        labels map[string]string
+        // weight was set by an operator rather than by config or discovery
+        weightOverridden bool
+
         alive        bool
         Circuit      CircuitState
         LastFailure  time.Time
@@ -31,6 +74,21 @@ type Backend struct {
 
         ActiveConnections int64
         AvgLatency        time.Duration
+
+        // draining backends get no new requests but let in-flight ones finish
+        draining      bool
+        drainStarted  time.Time
+        drainDeadline time.Time
+        // the drain was started by service discovery rather than an operator
+        discoveryDrain bool
+        // BackendDrained was published for the current drain; stragglers that
+        // arrive and finish afterwards don't publish it again
+        drainedPublished bool
+        // closed when draining starts, so long-lived tunnels can wind down
+        drainCh chan struct{}
+
+        // upgraded connections (WebSocket, h2c) currently open; also counted in ActiveConnections
+        tunnels int64
 }
 
 func NewBackend(rawURL string, weight int, proxy *httputil.ReverseProxy) (*Backend, error) {
@@ -46,9 +104,59 @@ func NewBackend(rawURL string, weight int, proxy *httputil.ReverseProxy) (*Backe
                 Circuit:           CircuitClosed,
                 ActiveConnections: 0,
                 AvgLatency:        0,
+                drainCh:           make(chan struct{}),
         }, nil
 }
 
+// --- weight & labels ---
+func (b *Backend) GetWeight() int {
+        b.mu.RLock()
+        defer b.mu.RUnlock()
+        return b.Weight
+}
+
+func (b *Backend) SetWeight(weight int) {
+        b.mu.Lock()
+        b.Weight = weight
+        b.mu.Unlock()
+}
+
+// OverrideWeight sets an operator-chosen weight that is persisted across restarts
+func (b *Backend) OverrideWeight(weight int) {
+        b.mu.Lock()
+        b.Weight = weight
+        b.weightOverridden = true
+        b.mu.Unlock()
+}
+
+func (b *Backend) WeightOverridden() bool {
+        b.mu.RLock()
+        defer b.mu.RUnlock()
+        return b.weightOverridden
+}
+
+// GetLabels returns a copy of the backend's labels
+func (b *Backend) GetLabels() map[string]string {
+        b.mu.RLock()
+        defer b.mu.RUnlock()
+        out := make(map[string]string, len(b.labels))
+        for k, v := range b.labels {
+                out[k] = v
+        }
+        return out
+}
+
+// SetLabels replaces the backend's labels with a copy of labels
+func (b *Backend) SetLabels(labels map[string]string) {
+        cp := make(map[string]string, len(labels))
+        for k, v := range labels {
+                cp[k] = v
+        }
+        b.mu.Lock()
+        b.labels = cp
+        b.mu.Unlock()
+}
+
 // -- health & alive ---
 func (b *Backend) SetAlive(alive bool) {
         b.mu.Lock()
@@ -77,7 +185,165 @@ func (b *Backend) DecConnections() {
         if b.ActiveConnections > 0 {
                 b.ActiveConnections--
         }
+        drained := b.draining && b.ActiveConnections == 0 && !b.drainedPublished
+        if drained {
+                b.drainedPublished = true
+        }
+        b.mu.Unlock()
+
+        if drained {
+                events.Publish(events.BackendDrained, b.URL.String(), "drain complete, no active connections")
+        }
+}
+
+// --- tunnels ---
+
+// TryOpenTunnel reserves a slot for an upgraded connection; max <= 0 means unlimited
+func (b *Backend) TryOpenTunnel(max int) bool {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+        if max > 0 && b.tunnels >= int64(max) {
+                return false
+        }
+        b.tunnels++
+        return true
+}
+
+func (b *Backend) CloseTunnel() {
+        b.mu.Lock()
+        if b.tunnels > 0 {
+                b.tunnels--
+        }
+        b.mu.Unlock()
+}
+
+func (b *Backend) GetActiveTunnels() int64 {
+        b.mu.RLock()
+        defer b.mu.RUnlock()
+        return b.tunnels
+}
+
+// --- draining ---
+
+// DrainStatus is a point-in-time view of a backend's drain progress
+type DrainStatus struct {
+        Draining          bool       `json:"draining"`
+        ActiveConnections int64      `json:"active_connections"`
+        Drained           bool       `json:"drained"`
+        StartedAt         *time.Time `json:"started_at,omitempty"`
+        Deadline          *time.Time `json:"deadline,omitempty"`
+        TimedOut          bool       `json:"timed_out"`
+}
+
+// StartDrain stops new requests from being routed to the backend. In-flight requests
+// keep running; timeout is how long callers are willing to wait for them (0 = no limit).
+func (b *Backend) StartDrain(timeout time.Duration) {
+        b.startDrain(timeout, false)
+}
+
+// DrainByDiscovery starts a drain on behalf of service discovery. Unlike an
+// operator's drain it is not persisted, and discovery may cancel it again.
+func (b *Backend) DrainByDiscovery(timeout time.Duration) {
+        b.startDrain(timeout, true)
+}
+
+// DrainedByDiscovery reports whether the current drain was started by service discovery
+func (b *Backend) DrainedByDiscovery() bool {
+        b.mu.RLock()
+        defer b.mu.RUnlock()
+        return b.draining && b.discoveryDrain
+}
+
+func (b *Backend) startDrain(timeout time.Duration, byDiscovery bool) {
+        b.mu.Lock()
+        already := b.draining
+        now := time.Now()
+        if !already {
+                close(b.drainCh)
+        }
+        // an operator's drain takes over one started by discovery, never the other way round
+        b.discoveryDrain = byDiscovery && (!already || b.discoveryDrain)
+        b.draining = true
+        b.drainStarted = now
+        b.drainDeadline = time.Time{}
+        if timeout > 0 {
+                b.drainDeadline = now.Add(timeout)
+        }
+        active := b.ActiveConnections
+        if !already {
+                b.drainedPublished = active == 0
+        }
         b.mu.Unlock()
+
+        if !already {
+                events.Publish(events.BackendDraining, b.URL.String(),
+                        fmt.Sprintf("draining started with %d active connections", active))
+                if active == 0 {
+                        events.Publish(events.BackendDrained, b.URL.String(), "drain complete, no active connections")
+                }
+        }
+}
+
+// StopDrain puts the backend back into rotation
+func (b *Backend) StopDrain() {
+        b.mu.Lock()
+        was := b.draining
+        if was {
+                b.drainCh = make(chan struct{})
+        }
+        b.draining = false
+        b.discoveryDrain = false
+        b.drainedPublished = false
+        b.drainStarted = time.Time{}
+        b.drainDeadline = time.Time{}
+        b.mu.Unlock()
+
+        if was {
+                events.Publish(events.BackendUndrained, b.URL.String(), "draining cancelled, backend back in rotation")
+        }
+}
+
+// DrainSignal returns a channel that is closed once the backend starts draining
+func (b *Backend) DrainSignal() <-chan struct{} {
+        b.mu.RLock()
+        defer b.mu.RUnlock()
+        return b.drainCh
+}
+
+func (b *Backend) IsDraining() bool {
+        b.mu.RLock()
+        defer b.mu.RUnlock()
+        return b.draining
+}
+
+func (b *Backend) GetDrainStatus() DrainStatus {
+        b.mu.RLock()
+        defer b.mu.RUnlock()
+
+        st := DrainStatus{
+                Draining:          b.draining,
+                ActiveConnections: b.ActiveConnections,
+        }
+        if !b.drainStarted.IsZero() {
+                started := b.drainStarted
+                st.StartedAt = &started
+        }
+        if !b.drainDeadline.IsZero() {
+                deadline := b.drainDeadline
+                st.Deadline = &deadline
+        }
+        st.Drained = b.draining && b.ActiveConnections == 0
+        st.TimedOut = b.draining && !st.Drained && !b.drainDeadline.IsZero() && time.Now().After(b.drainDeadline)
+        return st
+}
+
+// Available reports whether strategies may route new requests to this backend:
+// it must pass the circuit breaker gate and not be draining
+func (b *Backend) Available() bool {
+        if b.IsDraining() {
+                return false
+        }
+        return b.CheckCircuitState()
 }
 
 // --- latency tracking --- (simple EWMA)
@@ -116,30 +382,45 @@ const (
 
 func (b *Backend) RecordFailure() {
         b.mu.Lock()
-        defer b.mu.Unlock()
 
         b.FailureCount++
         b.LastFailure = time.Now()
 
         // if too many failures, open the circuit
+        opened := false
         if b.FailureCount >= MaxFailures && b.Circuit == CircuitClosed {
                 b.Circuit = CircuitOpen
+                opened = true
+        }
+        failures := b.FailureCount
+        b.mu.Unlock()
+
+        // publish outside the lock; subscribers may call back into the backend
+        if opened {
+                events.Publish(events.CircuitOpened, b.URL.String(),
+                        fmt.Sprintf("circuit opened after %d consecutive failures", failures))
         }
 }
 
 func (b *Backend) RecordSuccess() {
         b.mu.Lock()
-        defer b.mu.Unlock()
 
         b.FailureCount = 0
 
         // if backend was being tested (half-open), and succeeded, close the circuit
+        closed := false
         if b.Circuit == CircuitHalfOpen {
                 b.Circuit = CircuitClosed
+                closed = true
         }
         // Note: Do not set alive = true here. The health checker is the sole source
         // of truth for the alive status. This prevents request-level success from
         // overriding health check failures.
+        b.mu.Unlock()
+
+        if closed {
+                events.Publish(events.CircuitClosed, b.URL.String(), "circuit closed after successful trial request")
+        }
 }
 
 func (b *Backend) CheckCircuitState() bool {
@@ -170,8 +451,29 @@ func (b *Backend) CanAttemptHalfOpen() bool {
 
 func (b *Backend) SetCircuitHalfOpen() {
         b.mu.Lock()
+        changed := b.Circuit != CircuitHalfOpen
         b.Circuit = CircuitHalfOpen
         b.mu.Unlock()
+
+        if changed {
+                events.Publish(events.CircuitHalfOpen, b.URL.String(), "circuit half-open, allowing trial requests")
+        }
+}
+
+// RestoreCircuit reinstates a previously saved breaker state without publishing events
+func (b *Backend) RestoreCircuit(state CircuitState, failures int64, lastFailure time.Time) {
+        b.mu.Lock()
+        b.Circuit = state
+        b.FailureCount = failures
+        b.LastFailure = lastFailure
+        b.mu.Unlock()
+}
+
+// CircuitSnapshot returns the breaker state together with the failure bookkeeping behind it
+func (b *Backend) CircuitSnapshot() (CircuitState, int64, time.Time) {
+        b.mu.RLock()
+        defer b.mu.RUnlock()
+        return b.Circuit, b.FailureCount, b.LastFailure
 }
 
 func (b *Backend) GetCircuitState() CircuitState {
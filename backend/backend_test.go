@@ -0,0 +1,55 @@
+package backend
+
+import (
+	"polybalance/events"
+	"testing"
+	"time"
+)
+
+// TestBackendDrainedOncePerDrain checks that stragglers finishing on a drained
+// backend don't publish BackendDrained again, while a new drain does
+func TestBackendDrainedOncePerDrain(t *testing.T) {
+	b, err := NewBackend("http://10.0.0.7:8080", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, unsubscribe := events.Default.Subscribe(64)
+	defer unsubscribe()
+
+	drained := func() int {
+		n := 0
+		for {
+			select {
+			case e := <-ch:
+				if e.Type == events.BackendDrained && e.Backend == b.URL.String() {
+					n++
+				}
+			case <-time.After(20 * time.Millisecond):
+				return n
+			}
+		}
+	}
+
+	b.IncConnections()
+	b.StartDrain(time.Minute)
+	b.DecConnections()
+	if n := drained(); n != 1 {
+		t.Fatalf("drain completion published %d times, want 1", n)
+	}
+
+	for i := 0; i < 3; i++ { // stragglers, e.g. retries or tunnels
+		b.IncConnections()
+		b.DecConnections()
+	}
+	if n := drained(); n != 0 {
+		t.Errorf("stragglers published BackendDrained %d more times", n)
+	}
+
+	b.StopDrain()
+	b.StartDrain(time.Minute) // idle: drained at once
+	b.IncConnections()
+	b.DecConnections()
+	if n := drained(); n != 1 {
+		t.Errorf("second drain published BackendDrained %d times, want 1", n)
+	}
+}
@@ -0,0 +1,285 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Checker probes a single backend once and returns nil if it is healthy.
+// The context carries the probe timeout.
+type Checker interface {
+	Check(ctx context.Context, b *Backend) error
+}
+
+// HTTPChecker sends the request described by Spec and validates the response
+type HTTPChecker struct {
+	Spec   HealthCheckSpec
+	Client *http.Client
+}
+
+func NewHTTPChecker(spec HealthCheckSpec) *HTTPChecker {
+	if spec.Path == "" {
+		spec.Path = "/healthz"
+	}
+	if spec.Method == "" {
+		spec.Method = http.MethodGet
+	}
+
+	return &HTTPChecker{
+		Spec: spec,
+		Client: &http.Client{
+			// a redirect is a response in its own right; let ExpectedStatus decide
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (c *HTTPChecker) Check(ctx context.Context, b *Backend) error {
+	req, err := c.Spec.newRequest(b)
+	if err != nil {
+		return fmt.Errorf("building request: %w", err)
+	}
+
+	resp, err := c.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return c.Spec.evaluate(resp)
+}
+
+// TCPChecker only verifies that a TCP connection to the backend can be opened
+type TCPChecker struct {
+	Dialer net.Dialer
+}
+
+func NewTCPChecker() *TCPChecker {
+	return &TCPChecker{}
+}
+
+func (c *TCPChecker) Check(ctx context.Context, b *Backend) error {
+	conn, err := c.Dialer.DialContext(ctx, "tcp", hostPort(b.URL))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// TLSChecker completes a TLS handshake with the backend and optionally
+// checks the leaf certificate's remaining validity and subject alt names
+type TLSChecker struct {
+	// ServerName overrides the SNI / verification name (defaults to the backend host)
+	ServerName         string
+	InsecureSkipVerify bool
+
+	// MinValidity fails the check when the certificate expires sooner than this
+	MinValidity time.Duration
+	// RequiredSAN must be covered by the certificate's DNS or IP SANs
+	RequiredSAN string
+}
+
+func NewTLSChecker(serverName string, skipVerify bool, minValidity time.Duration, requiredSAN string) *TLSChecker {
+	return &TLSChecker{
+		ServerName:         serverName,
+		InsecureSkipVerify: skipVerify,
+		MinValidity:        minValidity,
+		RequiredSAN:        requiredSAN,
+	}
+}
+
+func (c *TLSChecker) Check(ctx context.Context, b *Backend) error {
+	serverName := c.ServerName
+	if serverName == "" {
+		serverName = b.URL.Hostname()
+	}
+
+	dialer := &tls.Dialer{
+		Config: &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: c.InsecureSkipVerify,
+			MinVersion:         tls.VersionTLS12,
+		},
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", hostPort(b.URL))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	state := conn.(*tls.Conn).ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no peer certificate presented")
+	}
+	leaf := state.PeerCertificates[0]
+
+	if c.MinValidity > 0 {
+		if remaining := time.Until(leaf.NotAfter); remaining < c.MinValidity {
+			return fmt.Errorf("certificate expires in %v (at %s)", remaining.Round(time.Second), leaf.NotAfter.Format(time.RFC3339))
+		}
+	}
+
+	if c.RequiredSAN != "" {
+		if err := leaf.VerifyHostname(c.RequiredSAN); err != nil {
+			return fmt.Errorf("certificate does not cover %q: %w", c.RequiredSAN, err)
+		}
+	}
+
+	return nil
+}
+
+// GRPCChecker calls the standard grpc.health.v1.Health/Check method over HTTP/2
+// (prior knowledge for http backends, ALPN for https ones) and requires SERVING
+type GRPCChecker struct {
+	// Service is the name asked about; empty means the server as a whole
+	Service string
+	Client  *http.Client
+}
+
+// NewGRPCChecker probes with tlsConfig for https backends (nil = system defaults)
+func NewGRPCChecker(service string, tlsConfig *tls.Config) *GRPCChecker {
+	return &GRPCChecker{
+		Service: service,
+		Client:  &http.Client{Transport: NewGRPCTransport(tlsConfig)},
+	}
+}
+
+// NewGRPCTransport returns a transport that speaks only HTTP/2, as gRPC probes need
+func NewGRPCTransport(tlsConfig *tls.Config) *http.Transport {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	return &http.Transport{
+		Protocols:       protocols,
+		TLSClientConfig: tlsConfig,
+	}
+}
+
+// health.v1 HealthCheckResponse.ServingStatus values
+var grpcServingStatus = []string{"UNKNOWN", "SERVING", "NOT_SERVING", "SERVICE_UNKNOWN"}
+
+func (c *GRPCChecker) Check(ctx context.Context, b *Backend) error {
+	// HealthCheckRequest{service = 1}, in a length-prefixed gRPC message
+	var msg []byte
+	if c.Service != "" {
+		msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+		msg = protowire.AppendString(msg, c.Service)
+	}
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	target := *b.URL
+	target.Path = "/grpc.health.v1.Health/Check"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.String(), bytes.NewReader(frame))
+	if err != nil {
+		return fmt.Errorf("building request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBodyBytes))
+	if err != nil {
+		return err
+	}
+
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status") // trailers-only response
+	}
+	if status != "0" {
+		message := resp.Trailer.Get("Grpc-Message")
+		if message == "" {
+			message = resp.Header.Get("Grpc-Message")
+		}
+		return fmt.Errorf("grpc-status %s: %s", status, message)
+	}
+
+	serving, err := parseHealthCheckResponse(body)
+	if err != nil {
+		return err
+	}
+	if serving != 1 {
+		name := "UNKNOWN"
+		if serving < uint64(len(grpcServingStatus)) {
+			name = grpcServingStatus[serving]
+		}
+		return fmt.Errorf("service reports %s", strings.ToLower(name))
+	}
+	return nil
+}
+
+// parseHealthCheckResponse returns the status field of a framed HealthCheckResponse
+func parseHealthCheckResponse(body []byte) (uint64, error) {
+	if len(body) < 5 {
+		return 0, errors.New("truncated gRPC response")
+	}
+	if body[0] != 0 {
+		return 0, errors.New("compressed gRPC response not supported")
+	}
+	size := binary.BigEndian.Uint32(body[1:5])
+	if uint32(len(body)-5) < size {
+		return 0, errors.New("truncated gRPC response")
+	}
+	msg := body[5 : 5+size]
+
+	var status uint64 // an absent field is UNKNOWN (0)
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		if num == 1 && typ == protowire.VarintType {
+			v, m := protowire.ConsumeVarint(msg)
+			if m < 0 {
+				return 0, protowire.ParseError(m)
+			}
+			status, msg = v, msg[m:]
+			continue
+		}
+		m := protowire.ConsumeFieldValue(num, typ, msg)
+		if m < 0 {
+			return 0, protowire.ParseError(m)
+		}
+		msg = msg[m:]
+	}
+	return status, nil
+}
+
+// hostPort returns host:port for a backend URL, filling in the scheme's default port
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -0,0 +1,61 @@
+package backend
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// grpcFrame wraps a message in the gRPC length-prefixed framing
+func grpcFrame(msg []byte) []byte {
+	frame := []byte{0}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+func TestParseHealthCheckResponse(t *testing.T) {
+	status := func(v uint64) []byte {
+		b := protowire.AppendTag(nil, 1, protowire.VarintType)
+		return protowire.AppendVarint(b, v)
+	}
+	// an unknown length-delimited field the parser must skip
+	unknown := protowire.AppendBytes(protowire.AppendTag(nil, 7, protowire.BytesType), []byte("extra"))
+
+	tests := []struct {
+		name    string
+		body    []byte
+		want    uint64
+		wantErr bool
+	}{
+		{name: "serving", body: grpcFrame(status(1)), want: 1},
+		{name: "not serving", body: grpcFrame(status(2)), want: 2},
+		{name: "service unknown", body: grpcFrame(status(3)), want: 3},
+		{name: "empty message is UNKNOWN", body: grpcFrame(nil), want: 0},
+		{name: "unknown fields skipped", body: grpcFrame(append(append(unknown, status(1)...), unknown...)), want: 1},
+		{name: "last status wins", body: grpcFrame(append(status(2), status(1)...)), want: 1},
+		{name: "trailing bytes after the frame", body: append(grpcFrame(status(1)), 0xff), want: 1},
+		{name: "short prefix", body: []byte{0, 0, 0}, wantErr: true},
+		{name: "compressed", body: append([]byte{1}, grpcFrame(status(1))[1:]...), wantErr: true},
+		{name: "message cut off", body: grpcFrame(status(1))[:6], wantErr: true},
+		{name: "truncated varint", body: grpcFrame([]byte{0x08, 0x80}), wantErr: true},
+		{name: "invalid tag", body: grpcFrame([]byte{0x00}), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHealthCheckResponse(tt.body)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseHealthCheckResponse() = %d, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseHealthCheckResponse() error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("parseHealthCheckResponse() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
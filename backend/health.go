@@ -2,22 +2,42 @@ package backend
 
 import (
 	"context"
+	"fmt"
 	"log"
-	"net/http"
+	"math/rand/v2"
+	"polybalance/events"
+	"polybalance/metrics"
 	"time"
 )
 
-// health.go periodically sends HTTP GET requests to each backend to determine whether the server is alive, and updates the backend’s health/circuit-breaker state accordingly
+// jitterFraction spreads each backend's probe schedule by up to ±10% of its interval
+const jitterFraction = 0.1
+
+// health.go periodically probes each backend with the configured Checker (HTTP, TCP or TLS) to determine whether the server is alive, and updates the backend’s health/circuit-breaker state accordingly
+//
+// Every backend is probed on its own goroutine so a slow backend never delays the others.
+// Health only flips after `fall` consecutive failures or `rise` consecutive successes (HAProxy-style),
+// and unhealthy backends are probed more often so recovery is detected quickly.
 type HealthChecker struct {
-	backends []*Backend
+	pool *BackendPool
+
+	interval          time.Duration
+	unhealthyInterval time.Duration
+	timeout           time.Duration
+	checker           Checker
+
+	rise int
+	fall int
+}
 
-	interval time.Duration
-	timeout  time.Duration
-	path     string
-	client   *http.Client
+// probeState tracks consecutive results for one backend; owned by that backend's probe goroutine
+type probeState struct {
+	healthy   bool
+	successes int
+	failures  int
 }
 
-func NewHealthChecker(backends []*Backend, interval, timeout time.Duration, path string) *HealthChecker {
+func NewHealthChecker(pool *BackendPool, interval, timeout time.Duration, checker Checker) *HealthChecker {
 	if interval <= 0 {
 		interval = 2 * time.Second
 	}
@@ -25,68 +45,154 @@ func NewHealthChecker(backends []*Backend, interval, timeout time.Duration, path
 		timeout = 1 * time.Second
 	}
 
-	if path == "" {
-		path = "/healthz"
+	if checker == nil {
+		checker = NewHTTPChecker(DefaultHealthCheckSpec())
 	}
 
 	return &HealthChecker{
-		backends: backends,
-		interval: interval,
-		timeout:  timeout,
-		path:     path,
-		client: &http.Client{
-			Timeout: timeout,
-		},
+		pool:              pool,
+		interval:          interval,
+		unhealthyInterval: interval / 2,
+		timeout:           timeout,
+		checker:           checker,
+		rise:              1,
+		fall:              1,
+	}
+}
+
+// SetThresholds sets how many consecutive successes (rise) mark a backend healthy
+// and how many consecutive failures (fall) mark it unhealthy
+func (hc *HealthChecker) SetThresholds(rise, fall int) {
+	if rise < 1 {
+		rise = 1
+	}
+	if fall < 1 {
+		fall = 1
 	}
+	hc.rise = rise
+	hc.fall = fall
 }
 
-// Start function begins the periodic health check loop on a goroutine
-// it stops when ctc is cancelled
+// SetUnhealthyInterval sets the probe interval used while a backend is unhealthy
+func (hc *HealthChecker) SetUnhealthyInterval(d time.Duration) {
+	if d <= 0 {
+		d = hc.interval
+	}
+	hc.unhealthyInterval = d
+}
+
+// Start function begins one probe loop per backend on its own goroutine, plus a
+// supervisor that starts and stops loops as backends join or leave the pool.
+// Everything stops when ctx is cancelled
 func (hc *HealthChecker) Start(ctx context.Context) {
-	ticker := time.NewTicker(hc.interval)
-
-	go func() {
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-ticker.C:
-				hc.checkAll()
+	go hc.supervise(ctx)
+}
+
+// supervise keeps exactly one probe loop running for every backend in the pool
+func (hc *HealthChecker) supervise(ctx context.Context) {
+	running := make(map[*Backend]context.CancelFunc)
+
+	reconcile := func() {
+		current := make(map[*Backend]bool)
+		for _, b := range hc.pool.Snapshot() {
+			current[b] = true
+			if _, ok := running[b]; !ok {
+				probeCtx, cancel := context.WithCancel(ctx)
+				running[b] = cancel
+				go hc.probeLoop(probeCtx, b)
 			}
 		}
-	}()
-}
+		for b, cancel := range running {
+			if !current[b] {
+				cancel()
+				delete(running, b)
+				metrics.BackendHealth.DeleteLabelValues(b.URL.String())
+			}
+		}
+	}
+
+	// pool changes are picked up within a second
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
-// checkAll probes every backend once
-func (hc *HealthChecker) checkAll() {
-	for _, b := range hc.backends {
-		hc.checkOne(b)
+	reconcile()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reconcile()
+		}
 	}
 }
 
-// checkOne sends a single HTTP request to a backend's health endpoint
-func (hc *HealthChecker) checkOne(b *Backend) {
-	u := *b.URL
-	u.Path = hc.path
+// probeLoop probes a single backend until ctx is cancelled. The first probe is
+// delayed by a random fraction of the interval so backends are not probed in lockstep.
+func (hc *HealthChecker) probeLoop(ctx context.Context, b *Backend) {
+	// start from the backend's own state: it may be restored or added as down
+	state := &probeState{healthy: b.IsAlive()}
+	health := 0.0
+	if state.healthy {
+		health = 1
+	}
+	metrics.BackendHealth.WithLabelValues(b.URL.String()).Set(health)
 
-	resp, err := hc.client.Get(u.String())
+	timer := time.NewTimer(time.Duration(rand.Int64N(int64(hc.interval))))
+	defer timer.Stop()
 
-	if err != nil {
-		log.Printf("Health check failed for backend %s: %v", b.URL.String(), err)
-		b.SetAlive(false)
-		b.RecordFailure()
-		return
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			hc.checkOne(ctx, b, state)
+			timer.Reset(hc.nextInterval(state))
+		}
 	}
-	defer resp.Body.Close()
+}
+
+// nextInterval returns the jittered delay until the next probe
+func (hc *HealthChecker) nextInterval(state *probeState) time.Duration {
+	base := hc.interval
+	if !state.healthy {
+		base = hc.unhealthyInterval
+	}
+	jitter := (rand.Float64()*2 - 1) * jitterFraction * float64(base)
+	return base + time.Duration(jitter)
+}
 
-	if resp.StatusCode >= 500 {
-		log.Printf("[health] Backend %s returned status code %d", b.URL.String(), resp.StatusCode)
-		b.SetAlive(false)
-		b.RecordFailure()
+// checkOne runs a single probe against a backend, bounded by the health check timeout,
+// and applies the rise/fall thresholds to the result. Probe results only drive
+// alive; the circuit breaker is left to proxied traffic, so the fall threshold
+// isn't pre-empted by the breaker's own failure count.
+func (hc *HealthChecker) checkOne(ctx context.Context, b *Backend, state *probeState) {
+	ctx, cancel := context.WithTimeout(ctx, hc.timeout)
+	defer cancel()
+
+	if err := hc.checker.Check(ctx, b); err != nil {
+		state.successes = 0
+		state.failures++
+		if state.healthy && state.failures >= hc.fall {
+			state.healthy = false
+			b.SetAlive(false)
+			metrics.BackendHealth.WithLabelValues(b.URL.String()).Set(0)
+			log.Printf("[health] Backend %s marked unhealthy after %d failed checks: %v", b.URL.String(), state.failures, err)
+			events.Publish(events.BackendUnhealthy, b.URL.String(),
+				fmt.Sprintf("marked unhealthy after %d failed checks: %v", state.failures, err))
+		} else if state.healthy {
+			log.Printf("[health] Backend %s failed health check (%d/%d): %v", b.URL.String(), state.failures, hc.fall, err)
+		}
 		return
 	}
 
-	b.SetAlive(true)
-	b.RecordSuccess()
+	state.failures = 0
+	state.successes++
+	if !state.healthy && state.successes >= hc.rise {
+		state.healthy = true
+		b.SetAlive(true)
+		metrics.BackendHealth.WithLabelValues(b.URL.String()).Set(1)
+		log.Printf("[health] Backend %s marked healthy after %d successful checks", b.URL.String(), state.successes)
+		events.Publish(events.BackendHealthy, b.URL.String(),
+			fmt.Sprintf("marked healthy after %d successful checks", state.successes))
+	}
 }
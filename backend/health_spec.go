@@ -0,0 +1,208 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxHealthBodyBytes caps how much of a health response body is read for body/JSON matching
+const maxHealthBodyBytes = 64 * 1024
+
+// StatusRange is an inclusive range of HTTP status codes accepted as healthy
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+func (sr StatusRange) Contains(code int) bool {
+	return code >= sr.Min && code <= sr.Max
+}
+
+// HealthCheckSpec describes the HTTP probe sent to every backend of a pool
+// and the rules a response must satisfy to count as healthy.
+type HealthCheckSpec struct {
+	Method  string
+	Path    string
+	Host    string
+	Headers map[string]string
+
+	// accepted status codes; empty means 200-399
+	ExpectedStatus []StatusRange
+
+	// optional body checks, all of which must pass
+	BodyContains string
+	BodyRegex    *regexp.Regexp
+	// dotted JSON path -> expected value, e.g. "status" -> "ok" or "checks.db" -> "true"
+	JSONFields map[string]string
+}
+
+// DefaultHealthCheckSpec returns a GET /healthz probe that accepts any 2xx/3xx response
+func DefaultHealthCheckSpec() HealthCheckSpec {
+	return HealthCheckSpec{
+		Method:         http.MethodGet,
+		Path:           "/healthz",
+		ExpectedStatus: []StatusRange{{Min: 200, Max: 399}},
+	}
+}
+
+// ParseStatusRanges parses a list such as "200-299,301" into status ranges
+func ParseStatusRanges(s string) ([]StatusRange, error) {
+	var ranges []StatusRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		lo, hi, isRange := strings.Cut(part, "-")
+		min, err := strconv.Atoi(strings.TrimSpace(lo))
+		if err != nil {
+			return nil, fmt.Errorf("invalid status %q", part)
+		}
+		max := min
+		if isRange {
+			max, err = strconv.Atoi(strings.TrimSpace(hi))
+			if err != nil {
+				return nil, fmt.Errorf("invalid status range %q", part)
+			}
+		}
+		if min < 100 || max > 599 || min > max {
+			return nil, fmt.Errorf("status range %q out of bounds", part)
+		}
+		ranges = append(ranges, StatusRange{Min: min, Max: max})
+	}
+	return ranges, nil
+}
+
+// needsBody reports whether the response body has to be read to evaluate the spec
+func (s *HealthCheckSpec) needsBody() bool {
+	return s.BodyContains != "" || s.BodyRegex != nil || len(s.JSONFields) > 0
+}
+
+// newRequest builds the probe request for the given backend base URL
+func (s *HealthCheckSpec) newRequest(b *Backend) (*http.Request, error) {
+	// the configured path may carry a query, e.g. /healthz?full=1
+	ref, err := url.Parse(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid health check path %q: %w", s.Path, err)
+	}
+	u := *b.URL
+	u.Path, u.RawPath = ref.Path, ref.RawPath
+	if ref.RawQuery != "" {
+		u.RawQuery = ref.RawQuery
+	}
+
+	method := s.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	if s.Host != "" {
+		req.Host = s.Host
+	}
+	return req, nil
+}
+
+// evaluate returns nil if the response satisfies the spec, otherwise the reason it does not
+func (s *HealthCheckSpec) evaluate(resp *http.Response) error {
+	if !s.statusAccepted(resp.StatusCode) {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	if !s.needsBody() {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBodyBytes))
+	if err != nil {
+		return fmt.Errorf("reading body: %w", err)
+	}
+
+	if s.BodyContains != "" && !strings.Contains(string(body), s.BodyContains) {
+		return fmt.Errorf("body does not contain %q", s.BodyContains)
+	}
+
+	if s.BodyRegex != nil && !s.BodyRegex.Match(body) {
+		return fmt.Errorf("body does not match %q", s.BodyRegex.String())
+	}
+
+	if len(s.JSONFields) > 0 {
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return fmt.Errorf("body is not valid JSON: %w", err)
+		}
+		for path, want := range s.JSONFields {
+			got, ok := lookupJSONPath(doc, path)
+			if !ok {
+				return fmt.Errorf("JSON field %q missing", path)
+			}
+			if got != want {
+				return fmt.Errorf("JSON field %q is %q, want %q", path, got, want)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *HealthCheckSpec) statusAccepted(code int) bool {
+	if len(s.ExpectedStatus) == 0 {
+		return code >= 200 && code <= 399
+	}
+	for _, sr := range s.ExpectedStatus {
+		if sr.Contains(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupJSONPath walks a decoded JSON document along a dotted path and
+// returns the leaf formatted as a string (numbers, bools and strings only)
+func lookupJSONPath(doc interface{}, path string) (string, bool) {
+	cur := doc
+	for _, key := range strings.Split(path, ".") {
+		switch node := cur.(type) {
+		case map[string]interface{}:
+			v, ok := node[key]
+			if !ok {
+				return "", false
+			}
+			cur = v
+		case []interface{}:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(node) {
+				return "", false
+			}
+			cur = node[idx]
+		default:
+			return "", false
+		}
+	}
+
+	switch v := cur.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case nil:
+		return "null", true
+	default:
+		return "", false
+	}
+}
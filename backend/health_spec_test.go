@@ -0,0 +1,35 @@
+package backend
+
+import "testing"
+
+func TestHealthCheckSpecRequestURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+		path    string
+		want    string
+	}{
+		{name: "plain path", backend: "http://10.0.0.1:8080", path: "/healthz", want: "http://10.0.0.1:8080/healthz"},
+		{name: "path with query", backend: "http://10.0.0.1:8080", path: "/healthz?full=1", want: "http://10.0.0.1:8080/healthz?full=1"},
+		{name: "backend query kept", backend: "http://10.0.0.1:8080/app?x=1", path: "/status", want: "http://10.0.0.1:8080/status?x=1"},
+		{name: "path query wins", backend: "http://10.0.0.1:8080/app?x=1", path: "/status?full=1", want: "http://10.0.0.1:8080/status?full=1"},
+		{name: "escaped path", backend: "https://api.internal", path: "/health%2Fdeep", want: "https://api.internal/health%2Fdeep"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := NewBackend(tt.backend, 1, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			spec := DefaultHealthCheckSpec()
+			spec.Path = tt.path
+			req, err := spec.newRequest(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := req.URL.String(); got != tt.want {
+				t.Errorf("probe URL = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
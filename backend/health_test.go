@@ -0,0 +1,59 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type checkerFunc func(ctx context.Context, b *Backend) error
+
+func (f checkerFunc) Check(ctx context.Context, b *Backend) error { return f(ctx, b) }
+
+// TestProbeLoopStartsFromBackendState checks that a backend that starts out down
+// is brought back by passing probes and kept down by failing ones
+func TestProbeLoopStartsFromBackendState(t *testing.T) {
+	tests := []struct {
+		name      string
+		alive     bool
+		probeErr  error
+		wantAlive bool
+	}{
+		{name: "down, passes", alive: false, wantAlive: true},
+		{name: "down, fails", alive: false, probeErr: errors.New("refused"), wantAlive: false},
+		{name: "up, fails", alive: true, probeErr: errors.New("refused"), wantAlive: false},
+		{name: "up, passes", alive: true, wantAlive: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := NewBackend("http://10.0.0.1:8080", 1, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.SetAlive(tt.alive)
+
+			probed := make(chan struct{}, 10)
+			hc := NewHealthChecker(NewBackendPool(nil), 10*time.Millisecond, time.Second,
+				checkerFunc(func(ctx context.Context, b *Backend) error {
+					probed <- struct{}{}
+					return tt.probeErr
+				}))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				hc.probeLoop(ctx, b)
+				close(done)
+			}()
+			<-probed
+			<-probed // the first probe's result has been applied
+			cancel()
+			<-done
+
+			if b.IsAlive() != tt.wantAlive {
+				t.Errorf("alive = %v, want %v", b.IsAlive(), tt.wantAlive)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package backend
+
+import (
+	"fmt"
+	"net/url"
+	"polybalance/events"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Factory builds a ready-to-use backend (with its reverse proxy) for a URL.
+// The proxy package provides the implementation; the pool only needs the signature.
+type Factory func(rawURL string, weight int) (*Backend, error)
+
+// BackendPool is the live set of backends shared by the server, health checker,
+// admin API and dashboard. Readers take lock-free copy-on-write snapshots;
+// writers serialize on mu and publish a brand new slice, so a snapshot is never
+// modified after it has been handed out.
+type BackendPool struct {
+	mu      sync.Mutex
+	current atomic.Pointer[[]*Backend]
+}
+
+func NewBackendPool(initial []*Backend) *BackendPool {
+	p := &BackendPool{}
+	snap := make([]*Backend, len(initial))
+	copy(snap, initial)
+	p.current.Store(&snap)
+	return p
+}
+
+// Snapshot returns the current backends. Callers must not modify the slice.
+func (p *BackendPool) Snapshot() []*Backend {
+	return *p.current.Load()
+}
+
+func (p *BackendPool) Len() int {
+	return len(p.Snapshot())
+}
+
+// Get looks a backend up by URL, ignoring a trailing slash
+func (p *BackendPool) Get(rawURL string) *Backend {
+	return findByURL(p.Snapshot(), rawURL)
+}
+
+// Mutate applies fn to a copy of the current backends and publishes the result
+// atomically. If fn returns an error the pool is left untouched.
+func (p *BackendPool) Mutate(fn func(backends []*Backend) ([]*Backend, error)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cur := p.Snapshot()
+	next := make([]*Backend, len(cur))
+	copy(next, cur)
+
+	next, err := fn(next)
+	if err != nil {
+		return err
+	}
+	p.current.Store(&next)
+	return nil
+}
+
+// Add appends a backend; URLs must be unique within the pool
+func (p *BackendPool) Add(b *Backend) error {
+	err := p.Mutate(func(backends []*Backend) ([]*Backend, error) {
+		if findByURL(backends, b.URL.String()) != nil {
+			return nil, fmt.Errorf("backend %s already exists", b.URL.String())
+		}
+		return append(backends, b), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	events.Publish(events.BackendAdded, b.URL.String(), fmt.Sprintf("backend added with weight %d", b.GetWeight()))
+	return nil
+}
+
+// Remove takes a backend out of the pool and returns it. Requests already
+// running against it are unaffected; drain it first for a graceful removal.
+func (p *BackendPool) Remove(rawURL string) (*Backend, error) {
+	var removed *Backend
+	err := p.Mutate(func(backends []*Backend) ([]*Backend, error) {
+		for i, b := range backends {
+			if sameURL(b.URL.String(), rawURL) {
+				removed = b
+				return append(backends[:i], backends[i+1:]...), nil
+			}
+		}
+		return nil, fmt.Errorf("backend %s not found", rawURL)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	events.Publish(events.BackendRemoved, removed.URL.String(), "backend removed from pool")
+	return removed, nil
+}
+
+// RemoveBackend takes out b itself, not whatever backend currently has its URL,
+// so a delayed removal (after a drain) can't hit a replacement added meanwhile
+func (p *BackendPool) RemoveBackend(b *Backend) error {
+	err := p.Mutate(func(backends []*Backend) ([]*Backend, error) {
+		for i, cur := range backends {
+			if cur == b {
+				return append(backends[:i], backends[i+1:]...), nil
+			}
+		}
+		return nil, fmt.Errorf("backend %s not found", b.URL.String())
+	})
+	if err != nil {
+		return err
+	}
+
+	events.Publish(events.BackendRemoved, b.URL.String(), "backend removed from pool")
+	return nil
+}
+
+// Replace swaps old for repl in place, keeping its position in the pool
+func (p *BackendPool) Replace(old, repl *Backend) error {
+	err := p.Mutate(func(backends []*Backend) ([]*Backend, error) {
+		if other := findByURL(backends, repl.URL.String()); other != nil && other != old {
+			return nil, fmt.Errorf("backend %s already exists", repl.URL.String())
+		}
+		for i, b := range backends {
+			if b == old {
+				backends[i] = repl
+				return backends, nil
+			}
+		}
+		return nil, fmt.Errorf("backend %s not found", old.URL.String())
+	})
+	if err != nil {
+		return err
+	}
+
+	events.Publish(events.BackendUpdated, repl.URL.String(), "backend replaced "+old.URL.String())
+	return nil
+}
+
+func findByURL(backends []*Backend, rawURL string) *Backend {
+	for _, b := range backends {
+		if sameURL(b.URL.String(), rawURL) {
+			return b
+		}
+	}
+	return nil
+}
+
+func sameURL(a, b string) bool {
+	return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+}
+
+// ValidateTCPURL checks a layer-4 backend address, written tcp://host:port
+func ValidateTCPURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "tcp" {
+		return fmt.Errorf("backend URL %q must use tcp in TCP mode", rawURL)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return fmt.Errorf("backend URL %q needs a host and port", rawURL)
+	}
+	return nil
+}
+
+// ValidateURL checks that a backend URL is absolute http(s) with a host
+func ValidateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("backend URL %q must use http or https", rawURL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("backend URL %q has no host", rawURL)
+	}
+	return nil
+}
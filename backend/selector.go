@@ -0,0 +1,125 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+)
+
+// selector.go implements label selectors used by routing rules to pick a subset of backends,
+// e.g. "version=v2,zone!=us-east-1c,canary,!legacy"
+
+type selectorOp int
+
+const (
+	opEquals selectorOp = iota
+	opNotEquals
+	opExists
+	opNotExists
+)
+
+type requirement struct {
+	key   string
+	op    selectorOp
+	value string
+}
+
+// Selector matches backends whose labels satisfy every requirement.
+// The zero value matches everything.
+type Selector struct {
+	reqs []requirement
+	raw  string
+}
+
+// ParseSelector parses a comma-separated list of requirements:
+//
+//	key=value / key==value   label present with that value
+//	key!=value               label absent or different
+//	key                      label present
+//	!key                     label absent
+func ParseSelector(s string) (Selector, error) {
+	sel := Selector{raw: strings.TrimSpace(s)}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var req requirement
+		switch {
+		case strings.Contains(part, "!="):
+			k, v, _ := strings.Cut(part, "!=")
+			req = requirement{key: strings.TrimSpace(k), op: opNotEquals, value: strings.TrimSpace(v)}
+		case strings.Contains(part, "=="):
+			k, v, _ := strings.Cut(part, "==")
+			req = requirement{key: strings.TrimSpace(k), op: opEquals, value: strings.TrimSpace(v)}
+		case strings.Contains(part, "="):
+			k, v, _ := strings.Cut(part, "=")
+			req = requirement{key: strings.TrimSpace(k), op: opEquals, value: strings.TrimSpace(v)}
+		case strings.HasPrefix(part, "!"):
+			req = requirement{key: strings.TrimSpace(part[1:]), op: opNotExists}
+		default:
+			req = requirement{key: part, op: opExists}
+		}
+
+		if req.key == "" {
+			return Selector{}, fmt.Errorf("invalid selector requirement %q", part)
+		}
+		sel.reqs = append(sel.reqs, req)
+	}
+	return sel, nil
+}
+
+func (s Selector) Empty() bool {
+	return len(s.reqs) == 0
+}
+
+func (s Selector) String() string {
+	return s.raw
+}
+
+// Matches reports whether labels satisfy every requirement
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s.reqs {
+		v, ok := labels[r.key]
+		switch r.op {
+		case opEquals:
+			if !ok || v != r.value {
+				return false
+			}
+		case opNotEquals:
+			if ok && v == r.value {
+				return false
+			}
+		case opExists:
+			if !ok {
+				return false
+			}
+		case opNotExists:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Filter returns the backends whose labels match the selector
+func (s Selector) Filter(backends []*Backend) []*Backend {
+	if s.Empty() {
+		return backends
+	}
+	out := make([]*Backend, 0, len(backends))
+	for _, b := range backends {
+		if b.MatchesSelector(s) {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// MatchesSelector checks the backend's labels without copying them
+func (b *Backend) MatchesSelector(s Selector) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return s.Matches(b.labels)
+}
@@ -2,20 +2,28 @@ package main
 
 import (
         "context"
+        "crypto/tls"
+        "fmt"
         "log"
+        "net"
         "net/http"
         "os"
         "os/signal"
+        "regexp"
         "syscall"
         "time"
 
         "flag"
+        "polybalance/admin"
         "polybalance/backend"
+        "polybalance/discovery"
+        "polybalance/events"
         "polybalance/internal"
         "polybalance/metrics"
         "polybalance/middleware"
         "polybalance/proxy"
         "polybalance/server"
+        "polybalance/state"
         "polybalance/strategy"
         "polybalance/ui"
 )
@@ -42,26 +50,94 @@ func main() {
         // ------------------------------
         // 2) Create backend objects
         // ------------------------------
+        // every backend, including ones added later by the admin API, discovery or
+        // restored state, gets its proxy from the same builder
+        proxyOpts := proxy.DefaultOptions()
+        proxyOpts.FlushInterval = cfg.FlushInterval
+        proxyOpts.UpstreamProtocol = cfg.UpstreamProtocol
+        proxyOpts.ProxyProtocol = cfg.UpstreamProxyProtocol
+        proxyOpts.GRPC = cfg.GRPC
+        grpcFailureCodes, err := proxy.ParseGRPCCodes(cfg.GRPCFailureCodes)
+        if err != nil {
+                log.Fatalf("Invalid LB_GRPC_FAILURE_CODES: %v", err)
+        }
+        proxyOpts.GRPCFailureCodes = grpcFailureCodes
+
+        var upstreamTLS *proxy.UpstreamTLS
+        if cfg.UpstreamTLSCAFile != "" || cfg.UpstreamTLSCertFile != "" || cfg.UpstreamTLSKeyFile != "" ||
+                cfg.UpstreamTLSServerName != "" || len(cfg.UpstreamTLSPins) > 0 {
+                upstreamTLS, err = proxy.NewUpstreamTLS(cfg.UpstreamTLSCAFile, cfg.UpstreamTLSCertFile,
+                        cfg.UpstreamTLSKeyFile, cfg.UpstreamTLSServerName, cfg.UpstreamTLSPins)
+                if err != nil {
+                        log.Fatalf("Invalid upstream TLS configuration: %v", err)
+                }
+                proxyOpts.UpstreamTLS = upstreamTLS
+        }
+        if err := proxyOpts.Validate(); err != nil {
+                log.Fatalf("Invalid upstream configuration: %v", err)
+        }
+        builder := proxy.NewBuilder(proxyOpts)
+
+        // in TCP mode backends are tcp://host:port addresses without a reverse proxy
+        var newBackend backend.Factory
+        validateURL := backend.ValidateURL
+        switch cfg.Mode {
+        case "http":
+                newBackend = builder.NewBackend
+        case "tcp":
+                newBackend = proxy.NewTCPBackend
+                validateURL = backend.ValidateTCPURL
+        default:
+                log.Fatalf("Invalid LB_MODE %q (want http or tcp)", cfg.Mode)
+        }
+
         backends := make([]*backend.Backend, 0, len(cfg.BackendURLs))
 
         for i, rawURL := range cfg.BackendURLs {
-                rp := proxy.NewReverseProxy(rawURL)
                 weight := 1
 
                 if i < len(cfg.Weights) {
                         weight = cfg.Weights[i]
                 }
 
-                b, err := backend.NewBackend(rawURL, weight, rp)
+                b, err := newBackend(rawURL, weight)
                 if err != nil {
                         logger.Error("Failed to create backend: %v", err)
                         continue
                 }
+                b.Origin = backend.OriginConfig
+                if i < len(cfg.BackendLabels) {
+                        b.SetLabels(cfg.BackendLabels[i])
+                }
 
                 backends = append(backends, b)
         }
 
-        if len(backends) == 0 {
+        if len(backends) == 0 && cfg.Discovery == "" && cfg.StateDir == "" {
+                log.Fatal("No valid backends available — shutting down.")
+        }
+
+        // the pool is shared by the server, health checker, admin API and dashboard
+        pool := backend.NewBackendPool(backends)
+
+        // restore operator decisions (drains, weight overrides, added backends) and
+        // circuit states from the previous run before anything is served
+        var stateStore *state.Store
+        if cfg.StateDir != "" {
+                var err error
+                stateStore, err = state.NewStore(cfg.StateDir, pool)
+                if err != nil {
+                        log.Fatalf("Invalid state directory: %v", err)
+                }
+                snap, err := stateStore.Load()
+                if err != nil {
+                        log.Fatalf("Failed to load saved state: %v", err)
+                }
+                n := stateStore.Restore(snap, newBackend)
+                logger.Info("Restored state for %d backend(s) from %s", n, cfg.StateDir)
+        }
+
+        if pool.Len() == 0 && cfg.Discovery == "" {
                 log.Fatal("No valid backends available — shutting down.")
         }
 
@@ -91,12 +167,36 @@ func main() {
         // ------------------------------
         // 4) Create HTTP server wrapper
         // ------------------------------
-        lbServer, err := server.NewServer(backends, strategyController)
+        lbServer, err := server.NewServer(pool, strategyController)
         if err != nil {
                 logger.Error("Failed to create load balancer server: %v", err)
                 return
         }
 
+        retryPolicy, err := server.NewRetryPolicy(cfg.MaxRetries, cfg.RetryOn)
+        if err != nil {
+                log.Fatalf("Invalid retry policy: %v", err)
+        }
+        lbServer.RetryPolicy = retryPolicy
+        lbServer.RetryBodyLimit = cfg.RetryBodyLimit
+        lbServer.RetryBudget = server.NewRetryBudget(cfg.RetryBudgetPercent, cfg.RetryBudgetMinPerSec)
+        lbServer.RetryBackoff = server.RetryBackoff{Base: cfg.RetryBackoff, Max: cfg.RetryBackoffMax}
+        lbServer.HedgeBudget = server.NewRetryBudget(cfg.HedgeBudgetPercent, cfg.HedgeBudgetMinPerSec)
+        lbServer.Timeouts = server.NewTimeoutPolicy(cfg.RequestTimeout, cfg.AttemptTimeout, cfg.IdleStreamTimeout)
+        lbServer.MaxClientTimeout = cfg.MaxClientTimeout
+        lbServer.HashHeader = cfg.HashHeader
+        lbServer.MaxTunnelsPerBackend = cfg.MaxTunnelsPerBackend
+        lbServer.TunnelIdleTimeout = cfg.TunnelIdleTimeout
+
+        if cfg.RoutesFile != "" {
+                routes, err := server.LoadRoutes(cfg.RoutesFile)
+                if err != nil {
+                        log.Fatalf("Invalid routes file: %v", err)
+                }
+                lbServer.Routes = routes
+                logger.Info("Loaded %d route(s) from %s", len(routes), cfg.RoutesFile)
+        }
+
         // ------------------------------
         // 5) Initialize Middleware
         // ------------------------------
@@ -116,6 +216,13 @@ func main() {
         logger.Info("Request limiter initialized (enabled=%v, maxBody=%d, maxHeader=%d)",
                 cfg.RequestLimitEnabled, cfg.MaxBodySize, cfg.MaxHeaderSize)
 
+        forwarding, err := middleware.NewForwarding(cfg.TrustedProxies, cfg.ForwardedPolicy)
+        if err != nil {
+                log.Fatalf("Invalid forwarding configuration: %v", err)
+        }
+        logger.Info("Client address resolution initialized (trusted proxies=%d, policy=%s)",
+                len(cfg.TrustedProxies), cfg.ForwardedPolicy)
+
         tlsConfig := middleware.NewTLSConfig(
                 cfg.TLSEnabled,
                 cfg.TLSCertFile,
@@ -125,17 +232,54 @@ func main() {
         logger.Info("TLS config initialized (enabled=%v, autoGen=%v)", cfg.TLSEnabled, cfg.TLSAutoGen)
 
         // ------------------------------
-        // 6) Start Health Checker
+        // 6) Start Service Discovery and Health Checker
         // ------------------------------
         ctx, cancel := context.WithCancel(context.Background())
+
+        if cfg.Discovery != "" {
+                provider, err := buildDiscoveryProvider(cfg, validateURL)
+                if err != nil {
+                        log.Fatalf("Invalid discovery configuration: %v", err)
+                }
+                reconciler := discovery.NewReconciler(pool, newBackend, cfg.DrainTimeout)
+                reconciler.ValidateURL = validateURL
+                if stateStore != nil {
+                        reconciler.Prepare = stateStore.ApplySaved
+                }
+                go reconciler.Run(ctx, provider)
+                logger.Info("Service discovery started (%s).", provider.Name())
+        }
+
+        if upstreamTLS != nil {
+                go upstreamTLS.Run(ctx, cfg.UpstreamTLSReloadInterval)
+                logger.Info("Upstream TLS enabled (ca=%q, client cert=%q, pins=%d).",
+                        cfg.UpstreamTLSCAFile, cfg.UpstreamTLSCertFile, len(cfg.UpstreamTLSPins))
+        }
+
+        checker, err := buildHealthChecker(cfg, upstreamTLS)
+        if err != nil {
+                log.Fatalf("Invalid health check configuration: %v", err)
+        }
         hc := backend.NewHealthChecker(
-                backends,
+                pool,
                 cfg.HealthInterval,
                 cfg.HealthTimeout,
-                "/healthz",
+                checker,
         )
+        hc.SetThresholds(cfg.HealthRise, cfg.HealthFall)
+        hc.SetUnhealthyInterval(cfg.HealthUnhealthyInterval)
         hc.Start(ctx)
-        logger.Info("Health checker initialized.")
+        logger.Info("Health checker initialized (type=%s, rise=%d, fall=%d).", cfg.HealthType, cfg.HealthRise, cfg.HealthFall)
+
+        if stateStore != nil {
+                go stateStore.Run(ctx, events.Default, cfg.StateSaveInterval)
+                logger.Info("Persisting runtime state to %s every %v.", cfg.StateDir, cfg.StateSaveInterval)
+        }
+
+        if len(cfg.EventWebhooks) > 0 {
+                events.NewWebhookSink(cfg.EventWebhooks, cfg.EventWebhookRetries, 5*time.Second).Start(ctx, events.Default)
+                logger.Info("Event webhooks enabled for %d receiver(s).", len(cfg.EventWebhooks))
+        }
 
         // ------------------------------
         // 7) Start Metrics Server (optional)
@@ -150,52 +294,108 @@ func main() {
         }
 
         // ------------------------------
-        // 8) Create Dashboard
+        // 8) Create Dashboard and admin API
         // ------------------------------
-        dashboard := ui.NewDashboard(backends, rateLimiter, requestLimiter, tlsConfig, strategyController)
+        dashboard := ui.NewDashboard(pool, rateLimiter, requestLimiter, tlsConfig, strategyController)
+        adminAPI := admin.NewAPI(pool, newBackend, cfg.DrainTimeout)
 
         // ------------------------------
         // 9) Start Main Load Balancer Server
         // ------------------------------
+        listener, err := net.Listen("tcp", cfg.ListenAddr)
+        if err != nil {
+                log.Fatalf("Failed to listen on %s: %v", cfg.ListenAddr, err)
+        }
+        if cfg.ProxyProtocol {
+                // the L4 balancer in front passes the client address in a PROXY header
+                listener, err = middleware.NewProxyProtocolListener(listener, cfg.ProxyProtocolTrusted, cfg.ProxyProtocolTimeout)
+                if err != nil {
+                        log.Fatalf("Invalid PROXY protocol configuration: %v", err)
+                }
+                logger.Info("Accepting PROXY protocol headers from %d trusted source(s)", len(cfg.ProxyProtocolTrusted))
+        }
+
+        // the admin API changes where traffic goes, so it is kept off the public
+        // listener; the dashboard is served alongside it so its drain controls work
         go func() {
                 mux := http.NewServeMux()
-
                 lbServer.RegisterHealthEndpoints(mux)
+                dashboard.RegisterAdminRoutes(mux)
+                adminAPI.RegisterRoutes(mux)
 
-                dashboard.RegisterRoutes(mux)
-
-                mux.Handle("/", lbServer)
+                logger.Info("Dashboard and admin API listening on %s", cfg.AdminAddr)
+                if err := http.ListenAndServe(cfg.AdminAddr, mux); err != nil {
+                        logger.Error("Admin server stopped: %v", err)
+                }
+        }()
 
-                var handler http.Handler = mux
-                handler = requestLimiter.Middleware(handler)
-                handler = rateLimiter.Middleware(handler)
+        if cfg.Mode == "tcp" {
+                tcpServer, err := server.NewTCPServer(pool, strategyController)
+                if err != nil {
+                        log.Fatalf("Failed to create TCP server: %v", err)
+                }
+                tcpServer.DialTimeout = cfg.TCPDialTimeout
+                tcpServer.IdleTimeout = cfg.TCPIdleTimeout
+                tcpServer.ProxyProtocol = cfg.UpstreamProxyProtocol
 
-                if cfg.TLSEnabled {
-                        tlsCfg, err := tlsConfig.GetTLSConfig()
-                        if err != nil {
-                                logger.Error("Failed to load TLS config: %v", err)
-                                cancel()
-                                return
+                go func() {
+                        logger.Info("Load balancer listening on %s (TCP mode)", cfg.ListenAddr)
+                        if err := tcpServer.Serve(listener); err != nil {
+                                logger.Error("TCP server stopped: %v", err)
                         }
+                        cancel()
+                }()
+        } else {
+                go func() {
+                        mux := http.NewServeMux()
+
+                        lbServer.RegisterHealthEndpoints(mux)
+
+                        dashboard.RegisterRoutes(mux)
+
+                        mux.Handle("/", lbServer)
+
+                        var handler http.Handler = mux
+                        handler = requestLimiter.Middleware(handler)
+                        handler = rateLimiter.Middleware(handler)
+                        handler = forwarding.Middleware(handler)
+
+                        // HTTP/2 is negotiated via ALPN on TLS; h2c (prior knowledge) lets internal
+                        // clients use it over cleartext
+                        protocols := new(http.Protocols)
+                        protocols.SetHTTP1(true)
+                        protocols.SetHTTP2(cfg.HTTP2)
+                        // gRPC needs HTTP/2, so gRPC mode accepts h2c too
+                        protocols.SetUnencryptedHTTP2(cfg.H2C || cfg.GRPC)
 
                         server := &http.Server{
                                 Addr:      cfg.ListenAddr,
                                 Handler:   handler,
-                                TLSConfig: tlsCfg,
+                                Protocols: protocols,
                         }
 
-                        logger.Info("Load balancer listening on %s (TLS enabled)", cfg.ListenAddr)
-                        if err := server.ListenAndServeTLS("", ""); err != nil {
-                                logger.Error("HTTPS server stopped: %v", err)
-                        }
-                } else {
-                        logger.Info("Load balancer listening on %s", cfg.ListenAddr)
-                        if err := http.ListenAndServe(cfg.ListenAddr, handler); err != nil {
-                                logger.Error("HTTP server stopped: %v", err)
+                        if cfg.TLSEnabled {
+                                tlsCfg, err := tlsConfig.GetTLSConfig()
+                                if err != nil {
+                                        logger.Error("Failed to load TLS config: %v", err)
+                                        cancel()
+                                        return
+                                }
+                                server.TLSConfig = tlsCfg
+
+                                logger.Info("Load balancer listening on %s (TLS enabled, http2=%v)", cfg.ListenAddr, cfg.HTTP2)
+                                if err := server.ServeTLS(listener, "", ""); err != nil {
+                                        logger.Error("HTTPS server stopped: %v", err)
+                                }
+                        } else {
+                                logger.Info("Load balancer listening on %s (h2c=%v)", cfg.ListenAddr, cfg.H2C)
+                                if err := server.Serve(listener); err != nil {
+                                        logger.Error("HTTP server stopped: %v", err)
+                                }
                         }
-                }
-                cancel()
-        }()
+                        cancel()
+                }()
+        }
 
         // ------------------------------
         // 10) Graceful shutdown on CTRL+C
@@ -208,3 +408,108 @@ func main() {
         cancel()
         time.Sleep(500 * time.Millisecond)
 }
+
+// buildDiscoveryProvider picks the backend source selected by LB_DISCOVERY
+func buildDiscoveryProvider(cfg *internal.Config, validateURL func(rawURL string) error) (discovery.Provider, error) {
+        switch cfg.Discovery {
+        case "dns":
+                if cfg.DNSName == "" {
+                        return nil, fmt.Errorf("LB_DNS_NAME is required for DNS discovery")
+                }
+                return discovery.NewDNSProvider(cfg.DNSName, cfg.DNSMode, cfg.DNSPort, cfg.DNSScheme, cfg.DNSServer, cfg.DNSMaxRefresh), nil
+        case "file":
+                if cfg.TargetsFile == "" {
+                        return nil, fmt.Errorf("LB_TARGETS_FILE is required for file discovery")
+                }
+                p := discovery.NewFileProvider(cfg.TargetsFile, cfg.TargetsFileInterval)
+                p.ValidateURL = validateURL
+                return p, nil
+        case "kubernetes":
+                if cfg.K8sService == "" {
+                        return nil, fmt.Errorf("LB_K8S_SERVICE is required for kubernetes discovery")
+                }
+                if cfg.K8sAPIServer != "" {
+                        // out-of-cluster (or a local stand-in API server)
+                        return discovery.NewKubernetesProvider(cfg.K8sAPIServer, cfg.K8sToken, nil,
+                                cfg.K8sNamespace, cfg.K8sService, cfg.K8sPortName, cfg.K8sScheme), nil
+                }
+                return discovery.NewInClusterKubernetesProvider(cfg.K8sNamespace, cfg.K8sService, cfg.K8sPortName, cfg.K8sScheme)
+        case "consul":
+                if cfg.ConsulService == "" {
+                        return nil, fmt.Errorf("LB_CONSUL_SERVICE is required for consul discovery")
+                }
+                return discovery.NewConsulProvider(cfg.ConsulAddr, cfg.ConsulService, cfg.ConsulTag,
+                        cfg.ConsulDatacenter, cfg.ConsulToken, cfg.ConsulScheme), nil
+        default:
+                return nil, fmt.Errorf("unknown discovery provider %q", cfg.Discovery)
+        }
+}
+
+// buildHealthChecker picks the probe implementation selected by LB_HEALTH_TYPE.
+// HTTP and gRPC probes reach https backends the way proxied requests do, through upstreamTLS.
+func buildHealthChecker(cfg *internal.Config, upstreamTLS *proxy.UpstreamTLS) (backend.Checker, error) {
+        switch cfg.HealthType {
+        case "", "http":
+                spec, err := buildHealthCheckSpec(cfg)
+                if err != nil {
+                        return nil, err
+                }
+                checker := backend.NewHTTPChecker(spec)
+                if upstreamTLS != nil {
+                        checker.Client.Transport = upstreamTLS.HostTransports(func(c *tls.Config) *http.Transport {
+                                return &http.Transport{TLSClientConfig: c}
+                        })
+                }
+                return checker, nil
+        case "tcp":
+                return backend.NewTCPChecker(), nil
+        case "tls":
+                return backend.NewTLSChecker(
+                        cfg.HealthTLSServerName,
+                        cfg.HealthTLSSkipVerify,
+                        cfg.HealthTLSMinValidity,
+                        cfg.HealthTLSRequiredSAN,
+                ), nil
+        case "grpc":
+                tlsConfig := &tls.Config{
+                        ServerName:         cfg.HealthTLSServerName,
+                        InsecureSkipVerify: cfg.HealthTLSSkipVerify,
+                        MinVersion:         tls.VersionTLS12,
+                }
+                checker := backend.NewGRPCChecker(cfg.HealthGRPCService, tlsConfig)
+                if upstreamTLS != nil {
+                        checker.Client.Transport = upstreamTLS.HostTransports(backend.NewGRPCTransport)
+                }
+                return checker, nil
+        default:
+                return nil, fmt.Errorf("unknown health check type %q", cfg.HealthType)
+        }
+}
+
+// buildHealthCheckSpec turns the LB_HEALTH_* settings into a probe spec
+func buildHealthCheckSpec(cfg *internal.Config) (backend.HealthCheckSpec, error) {
+        spec := backend.DefaultHealthCheckSpec()
+        spec.Method = cfg.HealthMethod
+        spec.Path = cfg.HealthPath
+        spec.Host = cfg.HealthHost
+        spec.Headers = cfg.HealthHeaders
+        spec.BodyContains = cfg.HealthBodyContains
+        spec.JSONFields = cfg.HealthJSONFields
+
+        ranges, err := backend.ParseStatusRanges(cfg.HealthExpectedStatus)
+        if err != nil {
+                return spec, err
+        }
+        if len(ranges) > 0 {
+                spec.ExpectedStatus = ranges
+        }
+
+        if cfg.HealthBodyRegex != "" {
+                re, err := regexp.Compile(cfg.HealthBodyRegex)
+                if err != nil {
+                        return spec, err
+                }
+                spec.BodyRegex = re
+        }
+        return spec, nil
+}
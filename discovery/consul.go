@@ -0,0 +1,253 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConsulProvider long-polls a Consul-compatible /v1/health/service/<name> endpoint
+// using blocking queries (?index=&wait=), so changes arrive as soon as the catalog
+// changes instead of on a fixed interval.
+//
+// Instances with any critical check (including maintenance mode) are left out.
+// Instances with a warning check stay in with their Weights.Warning weight, the
+// rest use Weights.Passing. A "weight" meta key overrides both. Service meta is
+// copied into labels, as are tags: "key=value" tags become that label, plain tags
+// become "tag_<name>"="true".
+type ConsulProvider struct {
+	Address    string // e.g. http://127.0.0.1:8500
+	Service    string
+	Tag        string // only instances carrying this tag
+	Datacenter string
+	Token      string
+	Scheme     string
+
+	Wait   time.Duration
+	Client *http.Client
+}
+
+// consulEntry is one element of the /v1/health/service response
+type consulEntry struct {
+	Node struct {
+		Node       string `json:"Node"`
+		Address    string `json:"Address"`
+		Datacenter string `json:"Datacenter"`
+	} `json:"Node"`
+	Service struct {
+		ID      string            `json:"ID"`
+		Service string            `json:"Service"`
+		Tags    []string          `json:"Tags"`
+		Address string            `json:"Address"`
+		Port    int               `json:"Port"`
+		Meta    map[string]string `json:"Meta"`
+		Weights struct {
+			Passing int `json:"Passing"`
+			Warning int `json:"Warning"`
+		} `json:"Weights"`
+	} `json:"Service"`
+	Checks []struct {
+		CheckID string `json:"CheckID"`
+		Status  string `json:"Status"`
+	} `json:"Checks"`
+}
+
+func NewConsulProvider(address, service, tag, datacenter, token, scheme string) *ConsulProvider {
+	if address == "" {
+		address = "http://127.0.0.1:8500"
+	}
+	if scheme == "" {
+		scheme = "http"
+	}
+	wait := 5 * time.Minute
+	return &ConsulProvider{
+		Address:    strings.TrimSuffix(address, "/"),
+		Service:    service,
+		Tag:        tag,
+		Datacenter: datacenter,
+		Token:      token,
+		Scheme:     scheme,
+		Wait:       wait,
+		// the server holds blocking queries for up to wait (+ jitter of wait/16)
+		Client: &http.Client{Timeout: wait + wait/16 + 10*time.Second},
+	}
+}
+
+func (p *ConsulProvider) Name() string {
+	return "consul:" + p.Service
+}
+
+func (p *ConsulProvider) Run(ctx context.Context, update func([]Target)) {
+	var index uint64
+	backoff := time.Second
+
+	for {
+		entries, newIndex, err := p.query(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("[discovery] %s: %v (retrying in %v)", p.Name(), err, backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+
+		var changed bool
+		index, changed = nextConsulIndex(index, newIndex)
+		if !changed {
+			continue
+		}
+
+		update(p.targets(entries))
+
+		if index == 0 {
+			// no usable index means we can't block; fall back to polling
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(10 * time.Second):
+			}
+		}
+	}
+}
+
+// nextConsulIndex returns the index for the next blocking query and whether the
+// response may carry changes
+func nextConsulIndex(index, newIndex uint64) (uint64, bool) {
+	// a blocking query that timed out returns the same index: nothing changed
+	if newIndex == index && index != 0 {
+		return index, false
+	}
+	// per Consul's guidance, reset when the index goes backwards or is invalid
+	if newIndex < index || newIndex == 0 {
+		return 0, true
+	}
+	return newIndex, true
+}
+
+func (p *ConsulProvider) query(ctx context.Context, index uint64) ([]consulEntry, uint64, error) {
+	q := url.Values{}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", p.Wait.String())
+	}
+	if p.Tag != "" {
+		q.Set("tag", p.Tag)
+	}
+	if p.Datacenter != "" {
+		q.Set("dc", p.Datacenter)
+	}
+
+	u := p.Address + "/v1/health/service/" + url.PathEscape(p.Service)
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if p.Token != "" {
+		req.Header.Set("X-Consul-Token", p.Token)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("decoding response: %w", err)
+	}
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	return entries, newIndex, nil
+}
+
+func (p *ConsulProvider) targets(entries []consulEntry) []Target {
+	var targets []Target
+	seen := make(map[string]bool)
+
+	for _, e := range entries {
+		status := "passing"
+		for _, c := range e.Checks {
+			switch c.Status {
+			case "critical":
+				status = "critical"
+			case "warning":
+				if status == "passing" {
+					status = "warning"
+				}
+			}
+		}
+		if status == "critical" {
+			continue
+		}
+
+		weight := e.Service.Weights.Passing
+		if status == "warning" {
+			weight = e.Service.Weights.Warning
+		}
+		if w, err := strconv.Atoi(e.Service.Meta["weight"]); err == nil {
+			weight = w
+		}
+		if weight <= 0 && (e.Service.Weights.Passing != 0 || e.Service.Weights.Warning != 0) {
+			// an explicit zero weight (e.g. Warning: 0) means "don't route here"
+			continue
+		}
+
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		u := p.Scheme + "://" + net.JoinHostPort(host, strconv.Itoa(e.Service.Port))
+		if seen[u] {
+			continue
+		}
+		seen[u] = true
+
+		labels := map[string]string{
+			"consul_service": e.Service.Service,
+			"consul_id":      e.Service.ID,
+			"consul_node":    e.Node.Node,
+			"consul_status":  status,
+		}
+		if e.Node.Datacenter != "" {
+			labels["datacenter"] = e.Node.Datacenter
+		}
+		for _, tag := range e.Service.Tags {
+			if k, v, ok := strings.Cut(tag, "="); ok {
+				labels[k] = v
+			} else {
+				labels["tag_"+tag] = "true"
+			}
+		}
+		for k, v := range e.Service.Meta {
+			labels[k] = v
+		}
+
+		targets = append(targets, Target{URL: u, Weight: weight, Labels: labels})
+	}
+
+	sort.Slice(targets, func(i, j int) bool { return targets[i].URL < targets[j].URL })
+	return targets
+}
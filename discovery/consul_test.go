@@ -0,0 +1,106 @@
+package discovery
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNextConsulIndex(t *testing.T) {
+	tests := []struct {
+		name        string
+		index       uint64
+		newIndex    uint64
+		wantIndex   uint64
+		wantChanged bool
+	}{
+		{name: "first query", index: 0, newIndex: 42, wantIndex: 42, wantChanged: true},
+		{name: "advanced", index: 42, newIndex: 50, wantIndex: 50, wantChanged: true},
+		{name: "blocking query timed out", index: 42, newIndex: 42, wantIndex: 42, wantChanged: false},
+		{name: "went backwards", index: 42, newIndex: 7, wantIndex: 0, wantChanged: true},
+		{name: "missing header", index: 42, newIndex: 0, wantIndex: 0, wantChanged: true},
+		{name: "still no index", index: 0, newIndex: 0, wantIndex: 0, wantChanged: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index, changed := nextConsulIndex(tt.index, tt.newIndex)
+			if index != tt.wantIndex || changed != tt.wantChanged {
+				t.Errorf("nextConsulIndex(%d, %d) = %d, %v; want %d, %v",
+					tt.index, tt.newIndex, index, changed, tt.wantIndex, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func TestConsulTargets(t *testing.T) {
+	tests := []struct {
+		name       string
+		entry      string
+		wantTarget bool
+		wantWeight int
+		wantStatus string
+	}{
+		{
+			name:       "passing",
+			entry:      `{"Checks": [{"Status": "passing"}, {"Status": "passing"}]}`,
+			wantTarget: true,
+			wantWeight: 3,
+			wantStatus: "passing",
+		},
+		{
+			name:       "warning uses the warning weight",
+			entry:      `{"Checks": [{"Status": "passing"}, {"Status": "warning"}]}`,
+			wantTarget: true,
+			wantWeight: 1,
+			wantStatus: "warning",
+		},
+		{
+			name:  "any critical check drops the instance",
+			entry: `{"Checks": [{"Status": "warning"}, {"Status": "critical"}, {"Status": "passing"}]}`,
+		},
+		{
+			name:  "maintenance mode",
+			entry: `{"Checks": [{"CheckID": "_service_maintenance:web-1", "Status": "critical"}]}`,
+		},
+		{
+			name:  "warning weight of zero",
+			entry: `{"Service": {"Weights": {"Passing": 3, "Warning": 0}}, "Checks": [{"Status": "warning"}]}`,
+		},
+		{
+			name:       "weight meta overrides",
+			entry:      `{"Service": {"Meta": {"weight": "9"}}, "Checks": [{"Status": "warning"}]}`,
+			wantTarget: true,
+			wantWeight: 9,
+			wantStatus: "warning",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// defaults shared by every case; the entry overrides what it sets
+			var e consulEntry
+			base := `{"Node": {"Node": "n1", "Address": "10.0.0.1"},
+				"Service": {"ID": "web-1", "Service": "web", "Port": 8080, "Weights": {"Passing": 3, "Warning": 1}}}`
+			if err := json.Unmarshal([]byte(base), &e); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.entry), &e); err != nil {
+				t.Fatal(err)
+			}
+
+			p := NewConsulProvider("", "web", "", "", "", "")
+			targets := p.targets([]consulEntry{e})
+			if !tt.wantTarget {
+				if len(targets) != 0 {
+					t.Fatalf("targets = %+v, want none", targets)
+				}
+				return
+			}
+			if len(targets) != 1 {
+				t.Fatalf("got %d targets, want 1", len(targets))
+			}
+			got := targets[0]
+			if got.URL != "http://10.0.0.1:8080" || got.Weight != tt.wantWeight || got.Labels["consul_status"] != tt.wantStatus {
+				t.Errorf("target = %+v; want weight %d, status %s", got, tt.wantWeight, tt.wantStatus)
+			}
+		})
+	}
+}
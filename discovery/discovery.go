@@ -0,0 +1,67 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"polybalance/backend"
+)
+
+// discovery.go defines how external sources (DNS, files, ...) feed the backend pool.
+// A Provider only reports the desired set of targets; the Reconciler turns that
+// into pool changes.
+
+// Target is one backend as reported by a discovery provider
+type Target struct {
+	URL    string
+	Weight int
+	Labels map[string]string
+
+	// Draining targets stay in the pool but receive no new requests
+	Draining bool
+}
+
+// Provider produces the desired backend set. Run blocks until ctx is cancelled,
+// calling update with the complete target list whenever it may have changed.
+type Provider interface {
+	Name() string
+	Run(ctx context.Context, update func([]Target))
+}
+
+// validateTargets rejects target lists that would leave the pool in a bad state.
+// validateURL checks each URL for the balancer's mode; nil means http(s) backends.
+// normalizeTargets rewrites each target URL the way url.Parse serializes it, which
+// is how the backend built from it reports its URL (e.g. with a lowercase scheme),
+// so a target and its backend are always found under the same key
+func normalizeTargets(targets []Target) ([]Target, error) {
+	out := make([]Target, len(targets))
+	for i, t := range targets {
+		u, err := url.Parse(t.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target URL %s: %w", t.URL, err)
+		}
+		t.URL = u.String()
+		out[i] = t
+	}
+	return out, nil
+}
+
+func validateTargets(targets []Target, validateURL func(rawURL string) error) error {
+	if validateURL == nil {
+		validateURL = backend.ValidateURL
+	}
+	seen := make(map[string]bool, len(targets))
+	for _, t := range targets {
+		if err := validateURL(t.URL); err != nil {
+			return err
+		}
+		if t.Weight < 0 {
+			return fmt.Errorf("target %s has negative weight %d", t.URL, t.Weight)
+		}
+		if seen[t.URL] {
+			return fmt.Errorf("duplicate target %s", t.URL)
+		}
+		seen[t.URL] = true
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNSProvider resolves a DNS name on an interval and reports the resulting targets.
+//
+// In "srv" mode the name is an SRV record (e.g. _http._tcp.api.internal); each record's
+// target/port becomes a backend with the record's weight, and only the lowest-priority
+// group is used (RFC 2782). In "a" mode the name's A and AAAA records are combined with
+// a fixed port. The next refresh happens when the shortest record TTL expires, bounded
+// by MinRefresh and MaxRefresh.
+type DNSProvider struct {
+	Host   string
+	Mode   string // "srv" or "a"
+	Port   int    // used in "a" mode
+	Scheme string // scheme for generated backend URLs, default http
+
+	// Server is the nameserver address (host:port); defaults to the first
+	// nameserver in /etc/resolv.conf
+	Server string
+
+	MinRefresh time.Duration
+	MaxRefresh time.Duration
+	Timeout    time.Duration
+}
+
+func NewDNSProvider(host, mode string, port int, scheme, server string, maxRefresh time.Duration) *DNSProvider {
+	if mode == "" {
+		mode = "srv"
+	}
+	if scheme == "" {
+		scheme = "http"
+	}
+	if server == "" {
+		server = systemNameserver()
+	}
+	if maxRefresh <= 0 {
+		maxRefresh = 30 * time.Second
+	}
+	return &DNSProvider{
+		Host:       host,
+		Mode:       mode,
+		Port:       port,
+		Scheme:     scheme,
+		Server:     server,
+		MinRefresh: time.Second,
+		MaxRefresh: maxRefresh,
+		Timeout:    2 * time.Second,
+	}
+}
+
+func (p *DNSProvider) Name() string {
+	return "dns:" + p.Host
+}
+
+func (p *DNSProvider) Run(ctx context.Context, update func([]Target)) {
+	for {
+		targets, ttl, err := p.Resolve(ctx)
+		wait := p.MaxRefresh
+		switch {
+		case err != nil:
+			// keep the current pool on lookup failures; retry soon
+			log.Printf("[discovery] %s: lookup failed: %v", p.Name(), err)
+			wait = p.MinRefresh * 5
+		case len(targets) == 0:
+			log.Printf("[discovery] %s: no records, keeping current backends", p.Name())
+		default:
+			update(targets)
+			if ttl < wait {
+				wait = ttl
+			}
+		}
+		if wait < p.MinRefresh {
+			wait = p.MinRefresh
+		}
+		if wait > p.MaxRefresh {
+			wait = p.MaxRefresh
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Resolve performs one lookup and returns the targets and the shortest TTL seen
+func (p *DNSProvider) Resolve(ctx context.Context) ([]Target, time.Duration, error) {
+	switch p.Mode {
+	case "srv":
+		return p.resolveSRV(ctx)
+	case "a":
+		return p.resolveA(ctx)
+	default:
+		return nil, 0, fmt.Errorf("unknown DNS discovery mode %q", p.Mode)
+	}
+}
+
+func (p *DNSProvider) resolveSRV(ctx context.Context) ([]Target, time.Duration, error) {
+	records, err := p.query(ctx, p.Host, dnsTypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var srvs []dnsRecord
+	addrs := make(map[string][]dnsRecord) // additional-section A/AAAA by owner name
+	for _, rr := range records {
+		switch rr.Type {
+		case dnsTypeSRV:
+			srvs = append(srvs, rr)
+		case dnsTypeA, dnsTypeAAAA:
+			key := strings.ToLower(strings.TrimSuffix(rr.Name, "."))
+			addrs[key] = append(addrs[key], rr)
+		}
+	}
+	if len(srvs) == 0 {
+		return nil, 0, nil
+	}
+
+	// only the lowest priority value is active
+	sort.Slice(srvs, func(i, j int) bool { return srvs[i].Priority < srvs[j].Priority })
+	best := srvs[0].Priority
+
+	ttl := time.Duration(srvs[0].TTL) * time.Second
+	var targets []Target
+	seen := make(map[string]bool)
+	for _, srv := range srvs {
+		if srv.Priority != best {
+			break
+		}
+		ttl = minTTL(ttl, srv.TTL)
+
+		host := strings.ToLower(strings.TrimSuffix(srv.Target, "."))
+		if host == "" {
+			continue // target "." means the service is decidedly not available (RFC 2782)
+		}
+		ips := addrs[host]
+		if len(ips) == 0 {
+			// server didn't include glue records; resolve the target ourselves
+			ips, err = p.lookupAddrs(ctx, host)
+			if err != nil {
+				// a partial list would drain healthy backends; keep the pool as it is
+				return nil, 0, fmt.Errorf("resolving SRV target %s: %w", host, err)
+			}
+		}
+
+		for _, ip := range ips {
+			ttl = minTTL(ttl, ip.TTL)
+			u := p.Scheme + "://" + net.JoinHostPort(ip.IP.String(), strconv.Itoa(int(srv.Port)))
+			if seen[u] {
+				continue
+			}
+			seen[u] = true
+			targets = append(targets, Target{
+				URL:    u,
+				Weight: int(srv.Weight),
+				Labels: map[string]string{
+					"dns_name":     host,
+					"srv_priority": strconv.Itoa(int(srv.Priority)),
+				},
+			})
+		}
+	}
+	return targets, ttl, nil
+}
+
+func (p *DNSProvider) resolveA(ctx context.Context) ([]Target, time.Duration, error) {
+	if p.Port <= 0 {
+		return nil, 0, errors.New("DNS discovery in \"a\" mode needs a port")
+	}
+	ips, err := p.lookupAddrs(ctx, p.Host)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(ips) == 0 {
+		return nil, 0, nil
+	}
+
+	ttl := time.Duration(ips[0].TTL) * time.Second
+	var targets []Target
+	for _, ip := range ips {
+		ttl = minTTL(ttl, ip.TTL)
+		targets = append(targets, Target{
+			URL:    p.Scheme + "://" + net.JoinHostPort(ip.IP.String(), strconv.Itoa(p.Port)),
+			Weight: 1,
+			Labels: map[string]string{"dns_name": p.Host},
+		})
+	}
+	return targets, ttl, nil
+}
+
+// lookupAddrs returns the A and AAAA records for host; an answer for either family is enough
+func (p *DNSProvider) lookupAddrs(ctx context.Context, host string) ([]dnsRecord, error) {
+	var out []dnsRecord
+	var lastErr error
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		records, err := p.query(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range records {
+			if rr.Type == qtype {
+				out = append(out, rr)
+			}
+		}
+	}
+	if len(out) == 0 && lastErr != nil && !errors.Is(lastErr, errNXDomain) {
+		return nil, lastErr
+	}
+	return out, nil
+}
+
+func (p *DNSProvider) query(ctx context.Context, name string, qtype uint16) ([]dnsRecord, error) {
+	dial := func(network string) (net.Conn, error) {
+		d := net.Dialer{Timeout: p.Timeout}
+		conn, err := d.DialContext(ctx, network, p.Server)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Now().Add(p.Timeout))
+		return conn, nil
+	}
+
+	records, err := dnsExchange(name, qtype, dial)
+	if errors.Is(err, errNXDomain) {
+		return nil, nil
+	}
+	return records, err
+}
+
+func minTTL(cur time.Duration, ttl uint32) time.Duration {
+	d := time.Duration(ttl) * time.Second
+	if d < cur {
+		return d
+	}
+	return cur
+}
+
+// systemNameserver returns the first nameserver from /etc/resolv.conf, or 127.0.0.1:53
+func systemNameserver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1:53"
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return "127.0.0.1:53"
+}
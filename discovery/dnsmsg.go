@@ -0,0 +1,247 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+)
+
+// dnsmsg.go is a minimal DNS wire-format client (RFC 1035 / RFC 2782), just enough
+// to resolve A, AAAA and SRV records together with their TTLs, which the standard
+// library resolver does not expose.
+
+const (
+	dnsTypeA    uint16 = 1
+	dnsTypeAAAA uint16 = 28
+	dnsTypeSRV  uint16 = 33
+
+	dnsClassIN uint16 = 1
+
+	dnsRcodeNXDomain = 3
+)
+
+// dnsRecord is one answer/additional record we care about
+type dnsRecord struct {
+	Name string
+	Type uint16
+	TTL  uint32
+
+	IP net.IP // A / AAAA
+
+	Priority uint16 // SRV
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+// buildDNSQuery encodes a recursive query for name/qtype
+func buildDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // RD
+	binary.BigEndian.PutUint16(msg[4:], 1)      // QDCOUNT
+
+	name = strings.TrimSuffix(name, ".")
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid DNS name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	return msg, nil
+}
+
+// parseDNSResponse decodes the answer and additional sections of a response to query id
+func parseDNSResponse(msg []byte, id uint16) (records []dnsRecord, truncated bool, err error) {
+	if len(msg) < 12 {
+		return nil, false, errors.New("short DNS message")
+	}
+	if binary.BigEndian.Uint16(msg[0:]) != id {
+		return nil, false, errors.New("DNS response ID mismatch")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	truncated = flags&0x0200 != 0
+	rcode := flags & 0x000f
+	if rcode == dnsRcodeNXDomain {
+		return nil, truncated, errNXDomain
+	}
+	if rcode != 0 {
+		return nil, truncated, fmt.Errorf("DNS server returned rcode %d", rcode)
+	}
+
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	an := int(binary.BigEndian.Uint16(msg[6:]))
+	ns := int(binary.BigEndian.Uint16(msg[8:]))
+	ar := int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	for i := 0; i < qd; i++ {
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return nil, truncated, err
+		}
+		off += 4 // qtype + qclass
+	}
+
+	for i := 0; i < an+ns+ar; i++ {
+		var rr dnsRecord
+		var keep bool
+		rr, keep, off, err = readDNSRecord(msg, off)
+		if err != nil {
+			return nil, truncated, err
+		}
+		// authority records (SOA/NS) are never useful here
+		if keep && (i < an || i >= an+ns) {
+			records = append(records, rr)
+		}
+	}
+	return records, truncated, nil
+}
+
+var errNXDomain = errors.New("no such DNS name")
+
+func readDNSRecord(msg []byte, off int) (dnsRecord, bool, int, error) {
+	var rr dnsRecord
+	name, off, err := readDNSName(msg, off)
+	if err != nil {
+		return rr, false, off, err
+	}
+	if off+10 > len(msg) {
+		return rr, false, off, errors.New("truncated DNS record header")
+	}
+	rr.Name = name
+	rr.Type = binary.BigEndian.Uint16(msg[off:])
+	class := binary.BigEndian.Uint16(msg[off+2:])
+	rr.TTL = binary.BigEndian.Uint32(msg[off+4:])
+	rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	if off+rdlen > len(msg) {
+		return rr, false, off, errors.New("truncated DNS record data")
+	}
+	rdata := msg[off : off+rdlen]
+	end := off + rdlen
+
+	if class != dnsClassIN {
+		return rr, false, end, nil
+	}
+
+	switch rr.Type {
+	case dnsTypeA:
+		if rdlen != 4 {
+			return rr, false, end, errors.New("bad A record length")
+		}
+		rr.IP = net.IP(append([]byte(nil), rdata...))
+	case dnsTypeAAAA:
+		if rdlen != 16 {
+			return rr, false, end, errors.New("bad AAAA record length")
+		}
+		rr.IP = net.IP(append([]byte(nil), rdata...))
+	case dnsTypeSRV:
+		if rdlen < 7 {
+			return rr, false, end, errors.New("bad SRV record length")
+		}
+		rr.Priority = binary.BigEndian.Uint16(rdata[0:])
+		rr.Weight = binary.BigEndian.Uint16(rdata[2:])
+		rr.Port = binary.BigEndian.Uint16(rdata[4:])
+		// the target may be compressed, so decode relative to the whole message
+		if rr.Target, _, err = readDNSName(msg, off+6); err != nil {
+			return rr, false, end, err
+		}
+	default:
+		return rr, false, end, nil
+	}
+	return rr, true, end, nil
+}
+
+// readDNSName decodes a possibly-compressed domain name starting at off
+// and returns it with the offset just past the name in the original position
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1 // offset after the name, set on the first pointer jump
+	for hops := 0; ; hops++ {
+		if off >= len(msg) || hops > 64 {
+			return "", 0, errors.New("malformed DNS name")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			off++
+			if next < 0 {
+				next = off
+			}
+			return strings.Join(labels, "."), next, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("malformed DNS name pointer")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errors.New("malformed DNS label")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// dnsExchange sends one query over UDP, retrying over TCP if the answer was truncated
+func dnsExchange(name string, qtype uint16, timeoutConn func(network string) (net.Conn, error)) ([]dnsRecord, error) {
+	id := uint16(rand.UintN(1 << 16))
+	query, err := buildDNSQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := timeoutConn("udp")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	records, truncated, err := parseDNSResponse(buf[:n], id)
+	if err != nil || !truncated {
+		return records, err
+	}
+
+	// answer didn't fit in a datagram: repeat over TCP with a 2-byte length prefix
+	tcp, err := timeoutConn("tcp")
+	if err != nil {
+		return nil, err
+	}
+	defer tcp.Close()
+
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := tcp.Write(append(framed, query...)); err != nil {
+		return nil, err
+	}
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(tcp, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(tcp, resp); err != nil {
+		return nil, err
+	}
+	records, _, err = parseDNSResponse(resp, id)
+	return records, err
+}
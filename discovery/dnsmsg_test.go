@@ -0,0 +1,341 @@
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dnsMsg builds wire-format DNS messages for tests
+type dnsMsg struct{ b []byte }
+
+func newDNSMsg(id, flags uint16, qd, an, ns, ar int) *dnsMsg {
+	m := &dnsMsg{}
+	for _, v := range []uint16{id, flags, uint16(qd), uint16(an), uint16(ns), uint16(ar)} {
+		m.b = binary.BigEndian.AppendUint16(m.b, v)
+	}
+	return m
+}
+
+// name appends an uncompressed name and returns its offset
+func (m *dnsMsg) name(name string) int {
+	off := len(m.b)
+	for _, label := range strings.Split(name, ".") {
+		m.b = append(m.b, byte(len(label)))
+		m.b = append(m.b, label...)
+	}
+	m.b = append(m.b, 0)
+	return off
+}
+
+func (m *dnsMsg) pointer(off int) {
+	m.b = binary.BigEndian.AppendUint16(m.b, 0xc000|uint16(off))
+}
+
+func (m *dnsMsg) question(qtype uint16) {
+	m.b = binary.BigEndian.AppendUint16(m.b, qtype)
+	m.b = binary.BigEndian.AppendUint16(m.b, dnsClassIN)
+}
+
+// rr appends the fixed part of a record (after its name) followed by rdata
+func (m *dnsMsg) rr(rtype uint16, ttl uint32, rdata []byte) {
+	m.b = binary.BigEndian.AppendUint16(m.b, rtype)
+	m.b = binary.BigEndian.AppendUint16(m.b, dnsClassIN)
+	m.b = binary.BigEndian.AppendUint32(m.b, ttl)
+	m.b = binary.BigEndian.AppendUint16(m.b, uint16(len(rdata)))
+	m.b = append(m.b, rdata...)
+}
+
+func srvData(priority, weight, port uint16, target []byte) []byte {
+	var b []byte
+	b = binary.BigEndian.AppendUint16(b, priority)
+	b = binary.BigEndian.AppendUint16(b, weight)
+	b = binary.BigEndian.AppendUint16(b, port)
+	return append(b, target...)
+}
+
+func TestReadDNSName(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     []byte
+		off     int
+		want    string
+		wantEnd int
+		wantErr bool
+	}{
+		{
+			name:    "plain",
+			msg:     []byte("\x03www\x07example\x03com\x00"),
+			want:    "www.example.com",
+			wantEnd: 17,
+		},
+		{
+			name:    "root",
+			msg:     []byte{0},
+			want:    "",
+			wantEnd: 1,
+		},
+		{
+			name: "pointer to earlier name",
+			// "example.com" at 0, then "www" + pointer to 0 at 13
+			msg:     []byte("\x07example\x03com\x00\x03www\xc0\x00"),
+			off:     13,
+			want:    "www.example.com",
+			wantEnd: 19, // just past the pointer, not past the name it points to
+		},
+		{
+			name:    "pointer loop",
+			msg:     []byte{0xc0, 0x00},
+			wantErr: true,
+		},
+		{
+			name:    "truncated pointer",
+			msg:     []byte{0xc0},
+			wantErr: true,
+		},
+		{
+			name:    "label runs past the message",
+			msg:     []byte("\x05ab"),
+			wantErr: true,
+		},
+		{
+			name:    "missing terminator",
+			msg:     []byte("\x03www"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, end, err := readDNSName(tt.msg, tt.off)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readDNSName() = %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readDNSName() error: %v", err)
+			}
+			if got != tt.want || end != tt.wantEnd {
+				t.Errorf("readDNSName() = %q, %d; want %q, %d", got, end, tt.want, tt.wantEnd)
+			}
+		})
+	}
+}
+
+// srvResponse answers _api._tcp.example.com SRV with one compressed target, an
+// NS record in the authority section and the target's A record as glue
+func srvResponse(id, flags uint16) []byte {
+	m := newDNSMsg(id, flags, 1, 1, 1, 1)
+	q := m.name("_api._tcp.example.com")
+	m.question(dnsTypeSRV)
+
+	m.pointer(q)
+	// target "node1" + pointer to "example.com" inside the question name
+	target := append([]byte("\x05node1"), 0xc0, byte(q+10))
+	m.rr(dnsTypeSRV, 30, srvData(10, 5, 8080, target))
+
+	m.pointer(q + 10)
+	m.rr(2, 300, append([]byte("\x02ns"), 0xc0, byte(q+10))) // NS
+
+	m.b = append(m.b, "\x05node1"...)
+	m.pointer(q + 10)
+	m.rr(dnsTypeA, 60, []byte{10, 0, 0, 1})
+	return m.b
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	t.Run("SRV with compressed target and glue", func(t *testing.T) {
+		records, truncated, err := parseDNSResponse(srvResponse(7, 0x8180), 7)
+		if err != nil || truncated {
+			t.Fatalf("parseDNSResponse() truncated=%v err=%v", truncated, err)
+		}
+		if len(records) != 2 {
+			t.Fatalf("got %d records, want SRV and A (authority skipped): %+v", len(records), records)
+		}
+		srv, a := records[0], records[1]
+		if srv.Type != dnsTypeSRV || srv.Name != "_api._tcp.example.com" || srv.Target != "node1.example.com" ||
+			srv.Priority != 10 || srv.Weight != 5 || srv.Port != 8080 || srv.TTL != 30 {
+			t.Errorf("SRV record = %+v", srv)
+		}
+		if a.Type != dnsTypeA || a.Name != "node1.example.com" || !a.IP.Equal(net.IPv4(10, 0, 0, 1)) || a.TTL != 60 {
+			t.Errorf("A record = %+v", a)
+		}
+	})
+
+	tests := []struct {
+		name          string
+		msg           []byte
+		wantErr       error
+		wantAnyErr    bool
+		wantTruncated bool
+	}{
+		{name: "ID mismatch", msg: srvResponse(8, 0x8180), wantAnyErr: true},
+		{name: "NXDOMAIN", msg: newDNSMsg(7, 0x8183, 0, 0, 0, 0).b, wantErr: errNXDomain},
+		{name: "SERVFAIL", msg: newDNSMsg(7, 0x8182, 0, 0, 0, 0).b, wantAnyErr: true},
+		{name: "short header", msg: []byte{0, 7, 0x81}, wantAnyErr: true},
+		{name: "TC flag", msg: newDNSMsg(7, 0x8380, 0, 0, 0, 0).b, wantTruncated: true},
+		{
+			name: "record data cut off",
+			msg: func() []byte {
+				b := srvResponse(7, 0x8180)
+				return b[:len(b)-2]
+			}(),
+			wantAnyErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, truncated, err := parseDNSResponse(tt.msg, 7)
+			switch {
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			case tt.wantAnyErr && err == nil:
+				t.Error("expected an error")
+			case tt.wantErr == nil && !tt.wantAnyErr && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			}
+			if truncated != tt.wantTruncated {
+				t.Errorf("truncated = %v, want %v", truncated, tt.wantTruncated)
+			}
+		})
+	}
+}
+
+// TestDNSExchangeTruncated checks that a truncated UDP answer is retried over TCP
+func TestDNSExchangeTruncated(t *testing.T) {
+	var networks []string
+	dial := func(network string) (net.Conn, error) {
+		networks = append(networks, network)
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			buf := make([]byte, 512)
+			if network == "udp" {
+				n, _ := server.Read(buf)
+				id := binary.BigEndian.Uint16(buf[:n])
+				server.Write(newDNSMsg(id, 0x8380, 0, 0, 0, 0).b) // TC, no answers
+				return
+			}
+			var lenBuf [2]byte
+			if _, err := server.Read(lenBuf[:]); err != nil {
+				return
+			}
+			n, _ := server.Read(buf[:binary.BigEndian.Uint16(lenBuf[:])])
+			resp := srvResponse(binary.BigEndian.Uint16(buf[:n]), 0x8180)
+			server.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+		}()
+		return client, nil
+	}
+
+	records, err := dnsExchange("_api._tcp.example.com", dnsTypeSRV, dial)
+	if err != nil {
+		t.Fatalf("dnsExchange() error: %v", err)
+	}
+	if strings.Join(networks, ",") != "udp,tcp" {
+		t.Errorf("dialed %v, want udp then tcp", networks)
+	}
+	if len(records) != 2 {
+		t.Errorf("got %d records over TCP, want 2", len(records))
+	}
+}
+
+// startTestDNSServer answers SRV queries with the given targets (port 9000, no
+// glue) and A queries for good.example.com; anything else gets SERVFAIL
+func startTestDNSServer(t *testing.T, srvTargets []string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			id := binary.BigEndian.Uint16(buf[:n])
+			qname, off, _ := readDNSName(buf[:n], 12)
+			qtype := binary.BigEndian.Uint16(buf[off:])
+
+			var resp []byte
+			switch {
+			case qtype == dnsTypeSRV:
+				m := newDNSMsg(id, 0x8180, 1, len(srvTargets), 0, 0)
+				q := m.name(qname)
+				m.question(dnsTypeSRV)
+				for _, target := range srvTargets {
+					m.pointer(q)
+					var tb dnsMsg
+					if target == "." {
+						tb.b = []byte{0} // the root name
+					} else {
+						tb.name(target)
+					}
+					m.rr(dnsTypeSRV, 30, srvData(0, 1, 9000, tb.b))
+				}
+				resp = m.b
+			case qname == "good.example.com" && qtype == dnsTypeA:
+				m := newDNSMsg(id, 0x8180, 1, 1, 0, 0)
+				q := m.name(qname)
+				m.question(dnsTypeA)
+				m.pointer(q)
+				m.rr(dnsTypeA, 30, []byte{10, 0, 0, 2})
+				resp = m.b
+			case qname == "good.example.com":
+				resp = newDNSMsg(id, 0x8180, 0, 0, 0, 0).b // no AAAA
+			default:
+				resp = newDNSMsg(id, 0x8182, 0, 0, 0, 0).b // SERVFAIL
+			}
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestResolveSRV(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "target resolved without glue", targets: []string{"good.example.com"}, want: []string{"http://10.0.0.2:9000"}},
+		// a partial list would drain healthy backends, so the refresh must fail as a whole
+		{name: "one target fails to resolve", targets: []string{"good.example.com", "bad.example.com"}, wantErr: true},
+		{name: "service not available", targets: []string{"."}},
+		{name: "root target next to a real one", targets: []string{".", "good.example.com"}, want: []string{"http://10.0.0.2:9000"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := startTestDNSServer(t, tt.targets)
+			p := NewDNSProvider("_api._tcp.example.com", "srv", 0, "http", server, time.Minute)
+			p.Timeout = time.Second
+
+			targets, _, err := p.Resolve(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Resolve() = %v, want an error so the current pool is kept", targets)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve() error: %v", err)
+			}
+			var got []string
+			for _, target := range targets {
+				got = append(got, target.URL)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// targetGroup is one entry of a targets file, modelled on Prometheus file_sd:
+//
+//	- targets: ["http://10.0.0.1:8080", "http://10.0.0.2:8080"]
+//	  weight: 2
+//	  labels: {zone: us-east-1a, version: v2}
+type targetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Weight  int               `json:"weight" yaml:"weight"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// FileProvider watches a JSON or YAML targets file by polling its contents.
+// A file that fails to parse or validate is ignored and the current pool kept.
+type FileProvider struct {
+	Path     string
+	Interval time.Duration
+
+	// ValidateURL checks target URLs as the Reconciler does, so a file with
+	// targets it would reject is ignored as a whole
+	ValidateURL func(rawURL string) error
+}
+
+func NewFileProvider(path string, interval time.Duration) *FileProvider {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	return &FileProvider{
+		Path:     path,
+		Interval: interval,
+	}
+}
+
+func (p *FileProvider) Name() string {
+	return "file:" + p.Path
+}
+
+func (p *FileProvider) Run(ctx context.Context, update func([]Target)) {
+	var lastHash [sha256.Size]byte
+	loaded := false
+
+	check := func() {
+		data, err := os.ReadFile(p.Path)
+		if err != nil {
+			log.Printf("[discovery] %s: %v", p.Name(), err)
+			return
+		}
+		hash := sha256.Sum256(data)
+		if loaded && hash == lastHash {
+			return
+		}
+
+		targets, err := parseTargetsFile(p.Path, data)
+		if err == nil {
+			err = validateTargets(targets, p.ValidateURL)
+		}
+		if err != nil {
+			log.Printf("[discovery] %s: ignoring invalid targets file: %v", p.Name(), err)
+			// remember the bad contents so the error is logged once per change
+			lastHash, loaded = hash, true
+			return
+		}
+
+		lastHash, loaded = hash, true
+		log.Printf("[discovery] %s: loaded %d target(s)", p.Name(), len(targets))
+		update(targets)
+	}
+
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	check()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
+
+// parseTargetsFile decodes a targets file; .json files are JSON, anything else YAML
+func parseTargetsFile(path string, data []byte) ([]Target, error) {
+	var groups []targetGroup
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&groups); err != nil {
+			return nil, fmt.Errorf("parsing JSON: %w", err)
+		}
+	} else {
+		if err := yaml.UnmarshalStrict(data, &groups); err != nil {
+			return nil, fmt.Errorf("parsing YAML: %w", err)
+		}
+	}
+
+	var targets []Target
+	for i, g := range groups {
+		if len(g.Targets) == 0 {
+			return nil, fmt.Errorf("group %d has no targets", i)
+		}
+		for _, t := range g.Targets {
+			targets = append(targets, Target{
+				URL:    strings.TrimSpace(t),
+				Weight: g.Weight,
+				Labels: g.Labels,
+			})
+		}
+	}
+	return targets, nil
+}
@@ -0,0 +1,392 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// In-cluster service account files mounted into every pod
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// KubernetesProvider watches the EndpointSlices of one Service through the API server
+// and reports pod IPs directly, so PolyBalance (not kube-proxy) balances across pods.
+//
+// Endpoint conditions map to targets as follows:
+//   - ready                      -> healthy target
+//   - serving and terminating    -> draining target (in-flight requests finish)
+//   - anything else              -> not a target
+//
+// The endpoint's zone, node, pod name and topology hints are carried as labels.
+type KubernetesProvider struct {
+	APIServer string // e.g. https://10.96.0.1:443
+	Token     string
+	// TokenFile, when set, is re-read before every list and watch, since
+	// projected service account tokens rotate; Token is the fallback
+	TokenFile string
+	Client    *http.Client
+
+	Namespace string
+	Service   string
+	PortName  string // EndpointSlice port to use; empty means the first port
+	Scheme    string
+}
+
+// k8s EndpointSlice (discovery.k8s.io/v1), only the fields we need
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	AddressType string `json:"addressType"`
+	Endpoints   []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready       *bool `json:"ready"`
+			Serving     *bool `json:"serving"`
+			Terminating *bool `json:"terminating"`
+		} `json:"conditions"`
+		Zone      *string `json:"zone"`
+		NodeName  *string `json:"nodeName"`
+		TargetRef *struct {
+			Kind string `json:"kind"`
+			Name string `json:"name"`
+		} `json:"targetRef"`
+		Hints *struct {
+			ForZones []struct {
+				Name string `json:"name"`
+			} `json:"forZones"`
+		} `json:"hints"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name *string `json:"name"`
+		Port *int    `json:"port"`
+	} `json:"ports"`
+}
+
+type endpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []endpointSlice `json:"items"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// errWatchExpired signals that the resourceVersion is too old and we must relist
+var errWatchExpired = errors.New("watch resource version expired")
+
+// NewInClusterKubernetesProvider configures a provider from the pod's service account.
+// namespace defaults to the pod's own namespace.
+func NewInClusterKubernetesProvider(namespace, service, portName, scheme string) (*KubernetesProvider, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a cluster (KUBERNETES_SERVICE_HOST/PORT unset)")
+	}
+
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("reading service account token: %w", err)
+	}
+	caPEM, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("reading service account CA: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no certificates in service account CA bundle")
+	}
+
+	if namespace == "" {
+		ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("reading pod namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12},
+		},
+	}
+	p := NewKubernetesProvider("https://"+net.JoinHostPort(host, port), strings.TrimSpace(string(token)), client, namespace, service, portName, scheme)
+	p.TokenFile = serviceAccountDir + "/token"
+	return p, nil
+}
+
+func NewKubernetesProvider(apiServer, token string, client *http.Client, namespace, service, portName, scheme string) *KubernetesProvider {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+	if scheme == "" {
+		scheme = "http"
+	}
+	return &KubernetesProvider{
+		APIServer: strings.TrimSuffix(apiServer, "/"),
+		Token:     token,
+		Client:    client,
+		Namespace: namespace,
+		Service:   service,
+		PortName:  portName,
+		Scheme:    scheme,
+	}
+}
+
+func (p *KubernetesProvider) Name() string {
+	return "kubernetes:" + p.Namespace + "/" + p.Service
+}
+
+// Run lists the Service's EndpointSlices, then watches for changes, relisting
+// whenever the watch breaks or its resource version expires
+func (p *KubernetesProvider) Run(ctx context.Context, update func([]Target)) {
+	backoff := time.Second
+	for {
+		err := p.listAndWatch(ctx, update)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && !errors.Is(err, errWatchExpired) {
+			log.Printf("[discovery] %s: %v (retrying in %v)", p.Name(), err, backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+	}
+}
+
+func (p *KubernetesProvider) listAndWatch(ctx context.Context, update func([]Target)) error {
+	slices := make(map[string]endpointSlice)
+
+	var list endpointSliceList
+	if err := p.get(ctx, p.slicesPath(nil), &list); err != nil {
+		return fmt.Errorf("listing EndpointSlices: %w", err)
+	}
+	for _, s := range list.Items {
+		slices[s.Metadata.Name] = s
+	}
+	update(p.targets(slices))
+
+	rv := list.Metadata.ResourceVersion
+	for {
+		var err error
+		rv, err = p.watch(ctx, rv, slices, update)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// watch streams changes starting at resourceVersion rv until the server ends the
+// watch; it returns the last resource version seen so the next watch can resume
+func (p *KubernetesProvider) watch(ctx context.Context, rv string, slices map[string]endpointSlice, update func([]Target)) (string, error) {
+	q := url.Values{}
+	q.Set("watch", "1")
+	q.Set("resourceVersion", rv)
+	q.Set("allowWatchBookmarks", "true")
+	q.Set("timeoutSeconds", "300")
+
+	resp, err := p.do(ctx, p.slicesPath(q))
+	if err != nil {
+		return rv, fmt.Errorf("watching EndpointSlices: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return rv, errWatchExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		return rv, fmt.Errorf("watching EndpointSlices: status %d", resp.StatusCode)
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var ev watchEvent
+		if err := dec.Decode(&ev); err != nil {
+			if ctx.Err() != nil {
+				return rv, ctx.Err()
+			}
+			return rv, nil // server closed the watch; resume from rv
+		}
+
+		switch ev.Type {
+		case "ERROR":
+			var status struct {
+				Code int `json:"code"`
+			}
+			json.Unmarshal(ev.Object, &status)
+			if status.Code == http.StatusGone {
+				return rv, errWatchExpired
+			}
+			return rv, fmt.Errorf("watch error: %s", string(ev.Object))
+
+		case "BOOKMARK":
+			var s endpointSlice
+			if err := json.Unmarshal(ev.Object, &s); err == nil {
+				rv = s.Metadata.ResourceVersion
+			}
+
+		case "ADDED", "MODIFIED", "DELETED":
+			var s endpointSlice
+			if err := json.Unmarshal(ev.Object, &s); err != nil {
+				return rv, fmt.Errorf("decoding EndpointSlice: %w", err)
+			}
+			rv = s.Metadata.ResourceVersion
+			if ev.Type == "DELETED" {
+				delete(slices, s.Metadata.Name)
+			} else {
+				slices[s.Metadata.Name] = s
+			}
+			update(p.targets(slices))
+		}
+	}
+}
+
+// targets flattens all slices into backend targets
+func (p *KubernetesProvider) targets(slices map[string]endpointSlice) []Target {
+	names := make([]string, 0, len(slices))
+	for name := range slices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var targets []Target
+	seen := make(map[string]bool)
+	for _, name := range names {
+		s := slices[name]
+		port, ok := p.slicePort(s)
+		if !ok {
+			continue
+		}
+
+		for _, ep := range s.Endpoints {
+			// the API says to read an unknown (nil) ready or serving as true
+			ready := ep.Conditions.Ready == nil || *ep.Conditions.Ready
+			serving := ep.Conditions.Serving == nil || *ep.Conditions.Serving
+			terminating := ep.Conditions.Terminating != nil && *ep.Conditions.Terminating
+
+			draining := false
+			switch {
+			case ready && !terminating:
+			case serving && terminating:
+				draining = true
+			default:
+				continue // not ready: leave it out entirely
+			}
+
+			labels := map[string]string{"k8s_service": p.Service, "k8s_namespace": p.Namespace}
+			if ep.Zone != nil {
+				labels["zone"] = *ep.Zone
+			}
+			if ep.NodeName != nil {
+				labels["node"] = *ep.NodeName
+			}
+			if ep.TargetRef != nil && ep.TargetRef.Kind == "Pod" {
+				labels["pod"] = ep.TargetRef.Name
+			}
+			if ep.Hints != nil && len(ep.Hints.ForZones) > 0 {
+				zones := make([]string, 0, len(ep.Hints.ForZones))
+				for _, z := range ep.Hints.ForZones {
+					zones = append(zones, z.Name)
+				}
+				labels["zone_hints"] = strings.Join(zones, ",")
+			}
+
+			// every address of an endpoint is fungible; the first one is enough
+			if len(ep.Addresses) == 0 {
+				continue
+			}
+			u := p.Scheme + "://" + net.JoinHostPort(ep.Addresses[0], strconv.Itoa(port))
+			if seen[u] {
+				continue
+			}
+			seen[u] = true
+			targets = append(targets, Target{URL: u, Weight: 1, Labels: labels, Draining: draining})
+		}
+	}
+	return targets
+}
+
+func (p *KubernetesProvider) slicePort(s endpointSlice) (int, bool) {
+	for _, sp := range s.Ports {
+		if sp.Port == nil {
+			continue
+		}
+		if p.PortName == "" || (sp.Name != nil && *sp.Name == p.PortName) {
+			return *sp.Port, true
+		}
+	}
+	return 0, false
+}
+
+func (p *KubernetesProvider) slicesPath(q url.Values) string {
+	if q == nil {
+		q = url.Values{}
+	}
+	q.Set("labelSelector", "kubernetes.io/service-name="+p.Service)
+	return fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s", url.PathEscape(p.Namespace), q.Encode())
+}
+
+func (p *KubernetesProvider) get(ctx context.Context, path string, out interface{}) error {
+	resp, err := p.do(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (p *KubernetesProvider) do(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.APIServer+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if token := p.token(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return p.Client.Do(req)
+}
+
+// token returns the current bearer token, reading TokenFile when it is set
+func (p *KubernetesProvider) token() string {
+	if p.TokenFile == "" {
+		return p.Token
+	}
+	data, err := os.ReadFile(p.TokenFile)
+	if err != nil {
+		log.Printf("[discovery] %s: reading token file: %v", p.Name(), err)
+		return p.Token
+	}
+	return strings.TrimSpace(string(data))
+}
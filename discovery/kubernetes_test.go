@@ -0,0 +1,105 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKubernetesEndpointConditions(t *testing.T) {
+	tests := []struct {
+		name         string
+		conditions   string
+		wantTarget   bool
+		wantDraining bool
+	}{
+		{name: "ready", conditions: `{"ready": true, "serving": true}`, wantTarget: true},
+		{name: "ready unset", conditions: `{}`, wantTarget: true},
+		{name: "not ready", conditions: `{"ready": false, "serving": false}`},
+		{name: "serving but not ready", conditions: `{"ready": false, "serving": true}`},
+		{
+			name:         "serving and terminating",
+			conditions:   `{"ready": false, "serving": true, "terminating": true}`,
+			wantTarget:   true,
+			wantDraining: true,
+		},
+		{name: "terminating, no longer serving", conditions: `{"ready": false, "serving": false, "terminating": true}`},
+		{
+			name:         "terminating, serving unset",
+			conditions:   `{"ready": false, "terminating": true}`,
+			wantTarget:   true,
+			wantDraining: true,
+		},
+		{
+			name:         "terminating, nothing else set",
+			conditions:   `{"terminating": true}`,
+			wantTarget:   true,
+			wantDraining: true,
+		},
+		{name: "not ready, serving unset", conditions: `{"ready": false}`},
+		{name: "ready but terminating and not serving", conditions: `{"ready": true, "serving": false, "terminating": true}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s endpointSlice
+			data := `{
+				"metadata": {"name": "web-abc"},
+				"addressType": "IPv4",
+				"endpoints": [{"addresses": ["10.0.0.1"], "conditions": ` + tt.conditions + `}],
+				"ports": [{"name": "http", "port": 8080}]
+			}`
+			if err := json.Unmarshal([]byte(data), &s); err != nil {
+				t.Fatal(err)
+			}
+
+			p := NewKubernetesProvider("https://k8s", "", nil, "prod", "web", "http", "")
+			targets := p.targets(map[string]endpointSlice{s.Metadata.Name: s})
+			if !tt.wantTarget {
+				if len(targets) != 0 {
+					t.Fatalf("targets = %+v, want none", targets)
+				}
+				return
+			}
+			if len(targets) != 1 {
+				t.Fatalf("got %d targets, want 1", len(targets))
+			}
+			if targets[0].URL != "http://10.0.0.1:8080" {
+				t.Errorf("URL = %q", targets[0].URL)
+			}
+			if targets[0].Draining != tt.wantDraining {
+				t.Errorf("Draining = %v, want %v", targets[0].Draining, tt.wantDraining)
+			}
+		})
+	}
+}
+
+// TestKubernetesTokenFile checks that a rotated service account token is picked up
+func TestKubernetesTokenFile(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("Authorization"))
+		w.Write([]byte(`{"metadata": {"resourceVersion": "1"}, "items": []}`))
+	}))
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	p := NewKubernetesProvider(srv.URL, "stale", srv.Client(), "prod", "web", "", "")
+	p.TokenFile = tokenFile
+
+	for _, token := range []string{"first\n", "second\n"} {
+		if err := os.WriteFile(tokenFile, []byte(token), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		var list endpointSliceList
+		if err := p.get(context.Background(), p.slicesPath(nil), &list); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != 2 || got[0] != "Bearer first" || got[1] != "Bearer second" {
+		t.Errorf("Authorization headers = %q, want the token file's current contents", got)
+	}
+}
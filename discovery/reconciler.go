@@ -0,0 +1,191 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"polybalance/backend"
+	"polybalance/events"
+	"sync"
+	"time"
+)
+
+// Reconciler applies target lists from a Provider to a BackendPool:
+// new targets are added, vanished ones are drained and then removed, and
+// targets that are still present keep their backend (and its health state).
+// It only ever touches backends it added itself, so statically configured or
+// admin-added backends are left alone.
+type Reconciler struct {
+	pool         *backend.BackendPool
+	newBackend   backend.Factory
+	drainTimeout time.Duration
+
+	// ValidateURL checks target URLs before anything is applied; nil accepts
+	// http(s) URLs, TCP mode sets backend.ValidateTCPURL
+	ValidateURL func(rawURL string) error
+
+	// Prepare is called for each new backend before it joins the pool, e.g. to
+	// re-apply an operator's saved drain or weight override
+	Prepare func(b *backend.Backend)
+
+	mu       sync.Mutex
+	owned    map[string]*backend.Backend // URL -> backend added by this reconciler
+	removing map[string]time.Time        // URL -> drain deadline
+}
+
+func NewReconciler(pool *backend.BackendPool, factory backend.Factory, drainTimeout time.Duration) *Reconciler {
+	if drainTimeout <= 0 {
+		drainTimeout = 30 * time.Second
+	}
+	return &Reconciler{
+		pool:         pool,
+		newBackend:   factory,
+		drainTimeout: drainTimeout,
+		owned:        make(map[string]*backend.Backend),
+		removing:     make(map[string]time.Time),
+	}
+}
+
+// Run feeds the provider's updates into the pool and removes drained backends until ctx is cancelled
+func (rc *Reconciler) Run(ctx context.Context, p Provider) {
+	go p.Run(ctx, func(targets []Target) {
+		if err := rc.Apply(targets); err != nil {
+			log.Printf("[discovery] %s: rejected update: %v", p.Name(), err)
+		}
+	})
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rc.sweep()
+		}
+	}
+}
+
+// Apply reconciles the pool with the desired targets. All additions are
+// published to the pool as a single atomic swap.
+func (rc *Reconciler) Apply(targets []Target) error {
+	targets, err := normalizeTargets(targets)
+	if err != nil {
+		return err
+	}
+	if err := validateTargets(targets, rc.ValidateURL); err != nil {
+		return err
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	// forget backends someone else removed from the pool (e.g. via the admin API)
+	for url, b := range rc.owned {
+		if rc.pool.Get(url) != b {
+			delete(rc.owned, url)
+			delete(rc.removing, url)
+		}
+	}
+
+	desired := make(map[string]Target, len(targets))
+	for _, t := range targets {
+		desired[t.URL] = t
+	}
+
+	// build backends for new targets up front so the pool swap can't fail halfway
+	var added []*backend.Backend
+	for _, t := range targets {
+		if rc.owned[t.URL] != nil || rc.pool.Get(t.URL) != nil {
+			continue
+		}
+		b, err := rc.newBackend(t.URL, weightOf(t))
+		if err != nil {
+			return fmt.Errorf("target %s: %w", t.URL, err)
+		}
+		b.SetLabels(t.Labels)
+		b.Origin = backend.OriginDiscovery
+		if rc.Prepare != nil {
+			rc.Prepare(b)
+		}
+		added = append(added, b)
+	}
+
+	if len(added) > 0 {
+		err := rc.pool.Mutate(func(backends []*backend.Backend) ([]*backend.Backend, error) {
+			return append(backends, added...), nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, b := range added {
+			rc.owned[b.URL.String()] = b
+			events.Publish(events.BackendAdded, b.URL.String(), "discovered backend added")
+		}
+	}
+
+	// update targets that are still present
+	for url, b := range rc.owned {
+		t, ok := desired[url]
+		if !ok {
+			continue
+		}
+		if _, wasRemoving := rc.removing[url]; wasRemoving {
+			// came back before the drain finished
+			delete(rc.removing, url)
+			if b.DrainedByDiscovery() {
+				b.StopDrain()
+			}
+		}
+		// operators' weights and drains win over what the provider reports
+		if !b.WeightOverridden() {
+			b.SetWeight(weightOf(t))
+		}
+		b.SetLabels(t.Labels)
+		if t.Draining && !b.IsDraining() {
+			b.DrainByDiscovery(rc.drainTimeout)
+		} else if !t.Draining && b.DrainedByDiscovery() {
+			b.StopDrain()
+		}
+	}
+
+	// drain targets that disappeared; sweep removes them once idle
+	for url, b := range rc.owned {
+		if _, ok := desired[url]; ok {
+			continue
+		}
+		if _, already := rc.removing[url]; already {
+			continue
+		}
+		b.DrainByDiscovery(rc.drainTimeout)
+		rc.removing[url] = time.Now().Add(rc.drainTimeout)
+	}
+
+	return nil
+}
+
+// sweep removes vanished backends once they have no active connections or their drain deadline passed
+func (rc *Reconciler) sweep() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	now := time.Now()
+	for url, deadline := range rc.removing {
+		b := rc.owned[url]
+		if b.GetActiveConnections() > 0 && now.Before(deadline) {
+			continue
+		}
+		if err := rc.pool.RemoveBackend(b); err != nil {
+			log.Printf("[discovery] Removing backend %s failed: %v", url, err)
+		}
+		delete(rc.removing, url)
+		delete(rc.owned, url)
+	}
+}
+
+func weightOf(t Target) int {
+	if t.Weight <= 0 {
+		return 1
+	}
+	return t.Weight
+}
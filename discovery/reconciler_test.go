@@ -0,0 +1,51 @@
+package discovery
+
+import (
+	"polybalance/backend"
+	"testing"
+)
+
+func newTestBackend(rawURL string, weight int) (*backend.Backend, error) {
+	return backend.NewBackend(rawURL, weight, nil)
+}
+
+// TestReconcilerNormalizesURLs checks that a target whose URL doesn't serialize back
+// unchanged keeps its backend across updates instead of being drained and re-added
+func TestReconcilerNormalizesURLs(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{name: "canonical", url: "http://10.0.0.1:8080"},
+		{name: "uppercase scheme", url: "HTTP://10.0.0.1:8080"},
+		{name: "mixed case scheme", url: "Http://10.0.0.1:8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := backend.NewBackendPool(nil)
+			rc := NewReconciler(pool, newTestBackend, 0)
+			targets := []Target{{URL: tt.url, Weight: 1}}
+
+			if err := rc.Apply(targets); err != nil {
+				t.Fatal(err)
+			}
+			first := pool.Snapshot()
+			if len(first) != 1 {
+				t.Fatalf("pool has %d backends, want 1", len(first))
+			}
+
+			for i := 0; i < 3; i++ {
+				if err := rc.Apply(targets); err != nil {
+					t.Fatal(err)
+				}
+			}
+			after := pool.Snapshot()
+			if len(after) != 1 || after[0] != first[0] {
+				t.Fatalf("backend was replaced: %d backends after refreshes", len(after))
+			}
+			if after[0].IsDraining() {
+				t.Error("backend is draining although its target is still listed")
+			}
+		})
+	}
+}
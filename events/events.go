@@ -0,0 +1,139 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// events.go is a small in-process pub/sub bus for backend and balancer state changes.
+// Publishers never block: a subscriber that falls behind simply misses events.
+
+// Type identifies what happened
+type Type string
+
+const (
+	BackendHealthy   Type = "backend_healthy"
+	BackendUnhealthy Type = "backend_unhealthy"
+
+	BackendAdded   Type = "backend_added"
+	BackendRemoved Type = "backend_removed"
+	BackendUpdated Type = "backend_updated"
+
+	BackendDraining  Type = "backend_draining"
+	BackendDrained   Type = "backend_drained"
+	BackendUndrained Type = "backend_undrained"
+
+	CircuitOpened   Type = "circuit_opened"
+	CircuitHalfOpen Type = "circuit_half_open"
+	CircuitClosed   Type = "circuit_closed"
+
+	StrategyChanged Type = "strategy_changed"
+	ConfigChanged   Type = "config_changed"
+)
+
+// Types lists every event type; SSE clients need it to subscribe to each named event
+var Types = []Type{
+	BackendHealthy, BackendUnhealthy,
+	BackendAdded, BackendRemoved, BackendUpdated,
+	BackendDraining, BackendDrained, BackendUndrained,
+	CircuitOpened, CircuitHalfOpen, CircuitClosed,
+	StrategyChanged, ConfigChanged,
+}
+
+// Event is a single state change
+type Event struct {
+	ID      uint64            `json:"id"`
+	Type    Type              `json:"type"`
+	Time    time.Time         `json:"time"`
+	Backend string            `json:"backend,omitempty"`
+	Message string            `json:"message"`
+	Data    map[string]string `json:"data,omitempty"`
+}
+
+type Bus struct {
+	mu      sync.Mutex
+	nextID  uint64
+	subs    map[uint64]chan Event
+	nextSub uint64
+
+	// ring of the most recent events, for late subscribers and the dashboard
+	history    []Event
+	historyCap int
+}
+
+func NewBus(historySize int) *Bus {
+	if historySize <= 0 {
+		historySize = 100
+	}
+	return &Bus{
+		subs:       make(map[uint64]chan Event),
+		historyCap: historySize,
+	}
+}
+
+// Default is the process-wide bus used by the backend, health checker, server and dashboard
+var Default = NewBus(200)
+
+// Publish stamps the event with an ID and time (if unset) and fans it out to all subscribers
+func (b *Bus) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	e.ID = b.nextID
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.history = append(b.history, e)
+	if len(b.history) > b.historyCap {
+		b.history = b.history[len(b.history)-b.historyCap:]
+	}
+
+	for _, ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			// slow subscriber: drop rather than stall the publisher
+		}
+	}
+}
+
+// Subscribe returns a channel receiving every event published from now on,
+// and a function that unsubscribes and closes the channel
+func (b *Bus) Subscribe(buffer int) (<-chan Event, func()) {
+	if buffer <= 0 {
+		buffer = 64
+	}
+	ch := make(chan Event, buffer)
+
+	b.mu.Lock()
+	b.nextSub++
+	id := b.nextSub
+	b.subs[id] = ch
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Recent returns a copy of the retained history, oldest first
+func (b *Bus) Recent() []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]Event, len(b.history))
+	copy(out, b.history)
+	return out
+}
+
+// Publish sends an event on the Default bus
+func Publish(t Type, backend, message string) {
+	Default.Publish(Event{Type: t, Backend: backend, Message: message})
+}
@@ -0,0 +1,79 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// sseKeepAlive is how often a comment line is sent so proxies don't close an idle stream
+const sseKeepAlive = 15 * time.Second
+
+// SSEHandler streams events from the bus as Server-Sent Events.
+// Events newer than the client's Last-Event-ID header, or a last_event_id query
+// parameter for a first connection (EventSource can't set headers), are replayed
+// from history first.
+func SSEHandler(bus *Bus) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		ch, unsubscribe := bus.Subscribe(128)
+		defer unsubscribe()
+
+		var lastID uint64
+		v := r.Header.Get("Last-Event-ID") // set by the browser when it reconnects
+		if v == "" {
+			v = r.URL.Query().Get("last_event_id")
+		}
+		if v != "" {
+			lastID, _ = strconv.ParseUint(v, 10, 64)
+			for _, e := range bus.Recent() {
+				if e.ID > lastID {
+					writeSSE(w, e)
+					lastID = e.ID
+				}
+			}
+		}
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(sseKeepAlive)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+			case e, ok := <-ch:
+				if !ok {
+					return
+				}
+				if e.ID <= lastID {
+					continue // already replayed from history
+				}
+				writeSSE(w, e)
+				flusher.Flush()
+			}
+		}
+	})
+}
+
+func writeSSE(w http.ResponseWriter, e Event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+}
@@ -0,0 +1,100 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// WebhookSink POSTs every event as JSON to a set of URLs, retrying with exponential backoff.
+// Each URL gets its own subscription and worker so one slow receiver doesn't hold up the others.
+type WebhookSink struct {
+	urls       []string
+	maxRetries int
+	backoff    time.Duration
+	client     *http.Client
+}
+
+func NewWebhookSink(urls []string, maxRetries int, timeout time.Duration) *WebhookSink {
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &WebhookSink{
+		urls:       urls,
+		maxRetries: maxRetries,
+		backoff:    500 * time.Millisecond,
+		client:     &http.Client{Timeout: timeout},
+	}
+}
+
+// Start subscribes to the bus and delivers events until ctx is cancelled
+func (s *WebhookSink) Start(ctx context.Context, bus *Bus) {
+	for _, u := range s.urls {
+		ch, unsubscribe := bus.Subscribe(256)
+		go func(url string) {
+			defer unsubscribe()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case e, ok := <-ch:
+					if !ok {
+						return
+					}
+					if err := s.deliver(ctx, url, e); err != nil {
+						log.Printf("[events] webhook %s dropped event %d (%s): %v", url, e.ID, e.Type, err)
+					}
+				}
+			}
+		}(u)
+	}
+}
+
+// deliver sends one event, retrying on network errors and non-2xx responses
+func (s *WebhookSink) deliver(ctx context.Context, url string, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	wait := s.backoff
+	for attempt := 0; ; attempt++ {
+		err = s.post(ctx, url, body)
+		if err == nil || attempt >= s.maxRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+func (s *WebhookSink) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
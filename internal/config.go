@@ -12,16 +12,108 @@ type Config struct {
 	ListenAddr     string
 	BackendURLs    []string
 	Weights        []int
+	BackendLabels  []map[string]string
+	RoutesFile     string
 	Strategy       string
+	HashHeader     string
 	HealthInterval time.Duration
 	HealthTimeout  time.Duration
 	MetricsEnabled bool
 	MetricsAddr    string
 
+	MaxRetries           int
+	RetryOn              []string
+	RetryBodyLimit       int64
+	RetryBudgetPercent   float64
+	RetryBudgetMinPerSec float64
+	RetryBackoff         time.Duration
+	RetryBackoffMax      time.Duration
+
+	HedgeBudgetPercent   float64
+	HedgeBudgetMinPerSec float64
+
+	RequestTimeout    time.Duration
+	AttemptTimeout    time.Duration
+	IdleStreamTimeout time.Duration
+	MaxClientTimeout  time.Duration
+
+	MaxTunnelsPerBackend int
+	TunnelIdleTimeout    time.Duration
+
+	FlushInterval time.Duration
+
+	HealthUnhealthyInterval time.Duration
+	HealthRise              int
+	HealthFall              int
+
+	HealthType           string
+	HealthMethod         string
+	HealthPath           string
+	HealthHost           string
+	HealthHeaders        map[string]string
+	HealthExpectedStatus string
+	HealthBodyContains   string
+	HealthBodyRegex      string
+	HealthJSONFields     map[string]string
+
+	HealthTLSServerName  string
+	HealthTLSSkipVerify  bool
+	HealthTLSMinValidity time.Duration
+	HealthTLSRequiredSAN string
+	HealthGRPCService    string
+
+	DrainTimeout time.Duration
+
+	StateDir          string
+	StateSaveInterval time.Duration
+
+	Discovery     string
+	DNSName       string
+	DNSMode       string
+	DNSPort       int
+	DNSScheme     string
+	DNSServer     string
+	DNSMaxRefresh time.Duration
+
+	TargetsFile         string
+	TargetsFileInterval time.Duration
+
+	K8sAPIServer string
+	K8sToken     string
+	K8sNamespace string
+	K8sService   string
+	K8sPortName  string
+	K8sScheme    string
+
+	ConsulAddr       string
+	ConsulService    string
+	ConsulTag        string
+	ConsulDatacenter string
+	ConsulToken      string
+	ConsulScheme     string
+
+	EventWebhooks       []string
+	EventWebhookRetries int
+
 	RateLimitEnabled bool
 	RateLimitMax     int
 	RateLimitWindow  time.Duration
 
+	TrustedProxies  []string
+	ForwardedPolicy string
+
+	ProxyProtocol         bool
+	ProxyProtocolTrusted  []string
+	ProxyProtocolTimeout  time.Duration
+	UpstreamProxyProtocol string
+
+	// Mode is "http" or "tcp" (layer-4 splicing). The admin API is only served
+	// on AdminAddr, with the dashboard and health endpoints
+	Mode           string
+	AdminAddr      string
+	TCPDialTimeout time.Duration
+	TCPIdleTimeout time.Duration
+
 	RequestLimitEnabled bool
 	MaxBodySize         int64
 	MaxHeaderSize       int
@@ -30,6 +122,20 @@ type Config struct {
 	TLSCertFile string
 	TLSKeyFile  string
 	TLSAutoGen  bool
+
+	HTTP2            bool
+	H2C              bool
+	UpstreamProtocol string
+
+	GRPC             bool
+	GRPCFailureCodes []string
+
+	UpstreamTLSCAFile         string
+	UpstreamTLSCertFile       string
+	UpstreamTLSKeyFile        string
+	UpstreamTLSServerName     string
+	UpstreamTLSPins           []string
+	UpstreamTLSReloadInterval time.Duration
 }
 
 func LoadConfig() *Config {
@@ -37,16 +143,106 @@ func LoadConfig() *Config {
 		ListenAddr:     getEnv("LB_LISTEN_ADDR", ":8080"),
 		BackendURLs:    parseCSV(getEnv("LB_BACKENDS", "")),
 		Weights:        parseIntCSV(getEnv("LB_WEIGHTS", "")),
+		BackendLabels:  parseLabelSets(getEnv("LB_BACKEND_LABELS", "")),
+		RoutesFile:     getEnv("LB_ROUTES_FILE", ""),
 		Strategy:       getEnv("LB_STRATEGY", "round_robin"),
+		HashHeader:     getEnv("LB_HASH_HEADER", ""),
 		HealthInterval: getDuration("LB_HEALTH_INTERVAL", 2*time.Second),
 		HealthTimeout:  getDuration("LB_HEALTH_TIMEOUT", 1*time.Second),
 		MetricsEnabled: getBool("LB_METRICS_ENABLED", true),
 		MetricsAddr:    getEnv("LB_METRICS_ADDR", ":9090"),
 
+		MaxRetries:           getInt("LB_MAX_RETRIES", 2),
+		RetryOn:              parseCSV(getEnv("LB_RETRY_ON", "")),
+		RetryBodyLimit:       getInt64("LB_RETRY_BODY_LIMIT", 1024*1024),
+		RetryBudgetPercent:   getFloat("LB_RETRY_BUDGET_PERCENT", 20),
+		RetryBudgetMinPerSec: getFloat("LB_RETRY_BUDGET_MIN_PER_SEC", 3),
+		RetryBackoff:         getDuration("LB_RETRY_BACKOFF", 25*time.Millisecond),
+		RetryBackoffMax:      getDuration("LB_RETRY_BACKOFF_MAX", 250*time.Millisecond),
+
+		HedgeBudgetPercent:   getFloat("LB_HEDGE_BUDGET_PERCENT", 10),
+		HedgeBudgetMinPerSec: getFloat("LB_HEDGE_BUDGET_MIN_PER_SEC", 1),
+
+		RequestTimeout:    getDuration("LB_REQUEST_TIMEOUT", 0),
+		AttemptTimeout:    getDuration("LB_ATTEMPT_TIMEOUT", 5*time.Second),
+		IdleStreamTimeout: getDuration("LB_IDLE_STREAM_TIMEOUT", 0),
+		MaxClientTimeout:  getDuration("LB_MAX_CLIENT_TIMEOUT", time.Minute),
+
+		MaxTunnelsPerBackend: getInt("LB_MAX_TUNNELS_PER_BACKEND", 0),
+		TunnelIdleTimeout:    getDuration("LB_TUNNEL_IDLE_TIMEOUT", 0),
+
+		FlushInterval: getDuration("LB_FLUSH_INTERVAL", 100*time.Millisecond),
+
+		HealthUnhealthyInterval: getDuration("LB_HEALTH_UNHEALTHY_INTERVAL", 1*time.Second),
+		HealthRise:              getInt("LB_HEALTH_RISE", 2),
+		HealthFall:              getInt("LB_HEALTH_FALL", 3),
+
+		HealthType:           getEnv("LB_HEALTH_TYPE", "http"),
+		HealthMethod:         getEnv("LB_HEALTH_METHOD", "GET"),
+		HealthPath:           getEnv("LB_HEALTH_PATH", "/healthz"),
+		HealthHost:           getEnv("LB_HEALTH_HOST", ""),
+		HealthHeaders:        parseKVCSV(getEnv("LB_HEALTH_HEADERS", ""), ":"),
+		HealthExpectedStatus: getEnv("LB_HEALTH_EXPECTED_STATUS", "200-399"),
+		HealthBodyContains:   getEnv("LB_HEALTH_BODY_CONTAINS", ""),
+		HealthBodyRegex:      getEnv("LB_HEALTH_BODY_REGEX", ""),
+		HealthJSONFields:     parseKVCSV(getEnv("LB_HEALTH_JSON_FIELDS", ""), "="),
+
+		HealthTLSServerName:  getEnv("LB_HEALTH_TLS_SERVER_NAME", ""),
+		HealthTLSSkipVerify:  getBool("LB_HEALTH_TLS_SKIP_VERIFY", false),
+		HealthTLSMinValidity: getDuration("LB_HEALTH_TLS_MIN_VALIDITY", 0),
+		HealthTLSRequiredSAN: getEnv("LB_HEALTH_TLS_SAN", ""),
+		HealthGRPCService:    getEnv("LB_HEALTH_GRPC_SERVICE", ""),
+
+		DrainTimeout: getDuration("LB_DRAIN_TIMEOUT", 30*time.Second),
+
+		StateDir:          getEnv("LB_STATE_DIR", ""),
+		StateSaveInterval: getDuration("LB_STATE_SAVE_INTERVAL", 5*time.Second),
+
+		Discovery:     getEnv("LB_DISCOVERY", ""),
+		DNSName:       getEnv("LB_DNS_NAME", ""),
+		DNSMode:       getEnv("LB_DNS_MODE", "srv"),
+		DNSPort:       getInt("LB_DNS_PORT", 80),
+		DNSScheme:     getEnv("LB_DNS_SCHEME", "http"),
+		DNSServer:     getEnv("LB_DNS_SERVER", ""),
+		DNSMaxRefresh: getDuration("LB_DNS_REFRESH", 30*time.Second),
+
+		TargetsFile:         getEnv("LB_TARGETS_FILE", ""),
+		TargetsFileInterval: getDuration("LB_TARGETS_FILE_INTERVAL", 5*time.Second),
+
+		K8sAPIServer: getEnv("LB_K8S_API_SERVER", ""),
+		K8sToken:     getEnv("LB_K8S_TOKEN", ""),
+		K8sNamespace: getEnv("LB_K8S_NAMESPACE", ""),
+		K8sService:   getEnv("LB_K8S_SERVICE", ""),
+		K8sPortName:  getEnv("LB_K8S_PORT_NAME", ""),
+		K8sScheme:    getEnv("LB_K8S_SCHEME", "http"),
+
+		ConsulAddr:       getEnv("LB_CONSUL_ADDR", "http://127.0.0.1:8500"),
+		ConsulService:    getEnv("LB_CONSUL_SERVICE", ""),
+		ConsulTag:        getEnv("LB_CONSUL_TAG", ""),
+		ConsulDatacenter: getEnv("LB_CONSUL_DC", ""),
+		ConsulToken:      getEnv("LB_CONSUL_TOKEN", ""),
+		ConsulScheme:     getEnv("LB_CONSUL_SCHEME", "http"),
+
+		EventWebhooks:       parseCSV(getEnv("LB_EVENT_WEBHOOKS", "")),
+		EventWebhookRetries: getInt("LB_EVENT_WEBHOOK_RETRIES", 3),
+
 		RateLimitEnabled: getBool("LB_RATE_LIMIT_ENABLED", false),
 		RateLimitMax:     getInt("LB_RATE_LIMIT_MAX", 100),
 		RateLimitWindow:  getDuration("LB_RATE_LIMIT_WINDOW", 60*time.Second),
 
+		TrustedProxies:  parseCSV(getEnv("LB_TRUSTED_PROXIES", "")),
+		ForwardedPolicy: getEnv("LB_FORWARDED_POLICY", "append"),
+
+		ProxyProtocol:         getBool("LB_PROXY_PROTOCOL", false),
+		ProxyProtocolTrusted:  parseCSV(getEnv("LB_PROXY_PROTOCOL_TRUSTED", "")),
+		ProxyProtocolTimeout:  getDuration("LB_PROXY_PROTOCOL_TIMEOUT", 5*time.Second),
+		UpstreamProxyProtocol: getEnv("LB_UPSTREAM_PROXY_PROTOCOL", ""),
+
+		Mode:           getEnv("LB_MODE", "http"),
+		AdminAddr:      getEnv("LB_ADMIN_ADDR", ":9091"),
+		TCPDialTimeout: getDuration("LB_TCP_DIAL_TIMEOUT", 5*time.Second),
+		TCPIdleTimeout: getDuration("LB_TCP_IDLE_TIMEOUT", 0),
+
 		RequestLimitEnabled: getBool("LB_REQUEST_LIMIT_ENABLED", false),
 		MaxBodySize:         getInt64("LB_MAX_BODY_SIZE", 10*1024*1024),
 		MaxHeaderSize:       getInt("LB_MAX_HEADER_SIZE", 8192),
@@ -55,10 +251,41 @@ func LoadConfig() *Config {
 		TLSCertFile: getEnv("LB_TLS_CERT_FILE", "cert.pem"),
 		TLSKeyFile:  getEnv("LB_TLS_KEY_FILE", "key.pem"),
 		TLSAutoGen:  getBool("LB_TLS_AUTO_GEN", true),
+
+		HTTP2:            getBool("LB_HTTP2", true),
+		H2C:              getBool("LB_H2C", false),
+		UpstreamProtocol: getEnv("LB_UPSTREAM_PROTOCOL", "http1"),
+
+		GRPC:             getBool("LB_GRPC", false),
+		GRPCFailureCodes: parseCSV(getEnv("LB_GRPC_FAILURE_CODES", "UNAVAILABLE")),
+
+		UpstreamTLSCAFile:         getEnv("LB_UPSTREAM_TLS_CA_FILE", ""),
+		UpstreamTLSCertFile:       getEnv("LB_UPSTREAM_TLS_CERT_FILE", ""),
+		UpstreamTLSKeyFile:        getEnv("LB_UPSTREAM_TLS_KEY_FILE", ""),
+		UpstreamTLSServerName:     getEnv("LB_UPSTREAM_TLS_SERVER_NAME", ""),
+		UpstreamTLSPins:           parseCSV(getEnv("LB_UPSTREAM_TLS_PINS", "")),
+		UpstreamTLSReloadInterval: getDuration("LB_UPSTREAM_TLS_RELOAD_INTERVAL", 30*time.Second),
 	}
 
-	if len(cfg.BackendURLs) == 0 {
-		log.Fatal("LB_BACKENDS cannot be empty (comma-separated list of backend URLs)")
+	// TCP backends have no HTTP endpoint to probe, and discovered ones are tcp:// URLs
+	if cfg.Mode == "tcp" {
+		if os.Getenv("LB_HEALTH_TYPE") == "" {
+			cfg.HealthType = "tcp"
+		}
+		for env, scheme := range map[string]*string{
+			"LB_DNS_SCHEME":    &cfg.DNSScheme,
+			"LB_K8S_SCHEME":    &cfg.K8sScheme,
+			"LB_CONSUL_SCHEME": &cfg.ConsulScheme,
+		} {
+			if os.Getenv(env) == "" {
+				*scheme = "tcp"
+			}
+		}
+	}
+
+	// with a state directory, admin-added backends from the last run are restored
+	if len(cfg.BackendURLs) == 0 && cfg.Discovery == "" && cfg.StateDir == "" {
+		log.Fatal("LB_BACKENDS cannot be empty (comma-separated list of backend URLs) unless LB_DISCOVERY or LB_STATE_DIR is set")
 	}
 
 	return cfg
@@ -108,6 +335,18 @@ func getInt64(key string, def int64) int64 {
 	return n
 }
 
+func getFloat(key string, def float64) float64 {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return def
+	}
+	return f
+}
+
 func getDuration(key string, def time.Duration) time.Duration {
 	val := os.Getenv(key)
 	if val == "" {
@@ -147,3 +386,34 @@ func parseIntCSV(s string) []int {
 	}
 	return out
 }
+
+// parseKVCSV parses "k1<sep>v1,k2<sep>v2" into a map, skipping malformed pairs
+func parseKVCSV(s, sep string) map[string]string {
+	out := make(map[string]string)
+	for _, part := range parseCSV(s) {
+		k, v, ok := strings.Cut(part, sep)
+		if !ok {
+			continue
+		}
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		out[k] = strings.TrimSpace(v)
+	}
+	return out
+}
+
+// parseLabelSets parses per-backend label sets separated by ';', in LB_BACKENDS order,
+// e.g. "version=v1,zone=a;version=v2,zone=b"
+func parseLabelSets(s string) []map[string]string {
+	if s == "" {
+		return nil
+	}
+	parts := strings.Split(s, ";")
+	out := make([]map[string]string, 0, len(parts))
+	for _, p := range parts {
+		out = append(out, parseKVCSV(p, "="))
+	}
+	return out
+}
@@ -54,6 +54,76 @@ var BackendHealth = prometheus.NewGaugeVec(
 	[]string{"backend"},
 )
 
+// Retries sent per backend (indexed by the backend the retry went to)
+var Retries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "polybalance_retries_total",
+		Help: "Number of retry attempts per backend",
+	},
+	[]string{"backend"},
+)
+
+// Retries skipped because the retry budget was exhausted
+var RetryBudgetExhausted = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "polybalance_retry_budget_exhausted_total",
+		Help: "Number of retries not attempted because the retry budget was exhausted",
+	},
+)
+
+// Hedged (duplicate) requests per backend (indexed by the backend the hedge went to)
+var Hedges = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "polybalance_hedges_total",
+		Help: "Number of hedged requests sent per backend",
+	},
+	[]string{"backend"},
+)
+
+// Hedges skipped because the hedging budget was exhausted
+var HedgeBudgetExhausted = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "polybalance_hedge_budget_exhausted_total",
+		Help: "Number of hedged requests not sent because the hedging budget was exhausted",
+	},
+)
+
+// Open upgraded connections (WebSocket, h2c) per backend
+var ActiveTunnels = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "polybalance_active_tunnels",
+		Help: "Current number of upgraded connections per backend",
+	},
+	[]string{"backend"},
+)
+
+// gRPC calls per backend and grpc-status (indexed by backend URL and status name)
+var GRPCResponses = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "polybalance_grpc_responses_total",
+		Help: "Number of proxied gRPC calls per backend and grpc-status",
+	},
+	[]string{"backend", "code"},
+)
+
+// Connections accepted in TCP mode per backend (indexed by backend URL)
+var TCPConnections = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "polybalance_tcp_connections_total",
+		Help: "Number of TCP connections spliced to each backend",
+	},
+	[]string{"backend"},
+)
+
+// Bytes spliced in TCP mode (direction is "sent" to the backend or "received" from it)
+var TCPBytes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "polybalance_tcp_bytes_total",
+		Help: "Number of bytes spliced per backend and direction in TCP mode",
+	},
+	[]string{"backend", "direction"},
+)
+
 // -------------------------------
 //      REGISTER METRICS
 // -------------------------------
@@ -64,6 +134,14 @@ func init() {
 	prometheus.MustRegister(ActiveConnections)
 	prometheus.MustRegister(RequestDuration)
 	prometheus.MustRegister(BackendHealth)
+	prometheus.MustRegister(Retries)
+	prometheus.MustRegister(RetryBudgetExhausted)
+	prometheus.MustRegister(Hedges)
+	prometheus.MustRegister(HedgeBudgetExhausted)
+	prometheus.MustRegister(ActiveTunnels)
+	prometheus.MustRegister(GRPCResponses)
+	prometheus.MustRegister(TCPConnections)
+	prometheus.MustRegister(TCPBytes)
 }
 
 // -------------------------------
@@ -0,0 +1,302 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Forwarding header policies
+const (
+	// ForwardedAppend passes on the headers a trusted proxy sent and adds this hop to them
+	ForwardedAppend = "append"
+	// ForwardedStrip drops incoming forwarding headers and sends only the resolved client
+	ForwardedStrip = "strip"
+)
+
+// ClientInfo is what the balancer knows about the client behind a request,
+// resolved once by Forwarding.Middleware
+type ClientInfo struct {
+	// IP is the real client address: the peer itself, or the first untrusted
+	// address found walking the forwarding chain back from the peer
+	IP string
+	// Proto and Host are the scheme and host the client originally used
+	Proto string
+	Host  string
+
+	peer    string   // the direct peer's IP
+	chain   []string // X-Forwarded-For entries from the trusted peer
+	elems   []string // Forwarded elements from the trusted peer
+	trusted bool     // whether the peer is a trusted proxy
+	policy  string
+}
+
+type clientInfoKey struct{}
+
+// ClientInfoFrom returns the client info stored by Forwarding.Middleware
+func ClientInfoFrom(ctx context.Context) (*ClientInfo, bool) {
+	ci, ok := ctx.Value(clientInfoKey{}).(*ClientInfo)
+	return ci, ok
+}
+
+// ClientIP returns the resolved client IP of r, or its peer address when the
+// forwarding middleware didn't run
+func ClientIP(r *http.Request) string {
+	if ci, ok := ClientInfoFrom(r.Context()); ok {
+		return ci.IP
+	}
+	return peerIP(r)
+}
+
+// Forwarding resolves the real client of every request from the peer address
+// and, when the peer is a trusted proxy, its Forwarded / X-Forwarded-* headers.
+// Headers from untrusted peers are never believed.
+type Forwarding struct {
+	trusted []netip.Prefix
+	policy  string
+}
+
+// NewForwarding takes trusted proxies as CIDRs or single IPs
+func NewForwarding(trustedProxies []string, policy string) (*Forwarding, error) {
+	switch policy {
+	case "":
+		policy = ForwardedAppend
+	case ForwardedAppend, ForwardedStrip:
+	default:
+		return nil, fmt.Errorf("unknown forwarded policy %q (want %s or %s)", policy, ForwardedAppend, ForwardedStrip)
+	}
+
+	trusted, err := parsePrefixes(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &Forwarding{trusted: trusted, policy: policy}, nil
+}
+
+func (f *Forwarding) isTrusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && containsAddr(f.trusted, addr)
+}
+
+// parsePrefixes parses CIDRs and single IPs (as /32 or /128)
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address or CIDR %q", s)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or CIDR %q", s)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Forwarding) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ci := f.Resolve(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientInfoKey{}, ci)))
+	})
+}
+
+// Resolve works out the client behind r
+func (f *Forwarding) Resolve(r *http.Request) *ClientInfo {
+	ci := &ClientInfo{
+		peer:   peerIP(r),
+		Proto:  "http",
+		Host:   r.Host,
+		policy: f.policy,
+	}
+	if r.TLS != nil {
+		ci.Proto = "https"
+	}
+	ci.IP = ci.peer
+	ci.trusted = f.isTrusted(ci.peer)
+	if !ci.trusted {
+		return ci
+	}
+
+	// Forwarded (RFC 7239) wins over the X-Forwarded-* family when both are present
+	var hops []string
+	if elems := headerList(r.Header.Values("Forwarded")); len(elems) > 0 {
+		ci.elems = elems
+		first := parseForwardedElement(elems[0])
+		if proto := first["proto"]; proto != "" {
+			ci.Proto = strings.ToLower(proto)
+		}
+		if host := first["host"]; host != "" {
+			ci.Host = host
+		}
+		for _, elem := range elems {
+			hops = append(hops, forwardedNodeIP(parseForwardedElement(elem)["for"]))
+		}
+	} else {
+		hops = headerList(r.Header.Values("X-Forwarded-For"))
+		if proto := firstValue(r.Header.Get("X-Forwarded-Proto")); proto != "" {
+			ci.Proto = strings.ToLower(proto)
+		}
+		if host := firstValue(r.Header.Get("X-Forwarded-Host")); host != "" {
+			ci.Host = host
+		}
+		for _, hop := range hops {
+			ci.elems = append(ci.elems, "for="+quoteForwarded(forwardedNode(hop)))
+		}
+	}
+	// each header family is passed on even if the proxy before us only sent the other
+	ci.chain = hops
+
+	// walk back from the peer: the first hop not run by a trusted proxy is the client
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i] == "" {
+			continue
+		}
+		ci.IP = hops[i]
+		if !f.isTrusted(hops[i]) {
+			break
+		}
+	}
+	return ci
+}
+
+// SetForwardingHeaders writes Forwarded, X-Forwarded-For, X-Forwarded-Proto and
+// X-Forwarded-Host to an outgoing request for in, following the policy.
+// Without Forwarding.Middleware in front, no proxy is trusted.
+func SetForwardingHeaders(out http.Header, in *http.Request) {
+	ci, ok := ClientInfoFrom(in.Context())
+	if !ok {
+		ci = (&Forwarding{policy: ForwardedAppend}).Resolve(in)
+	}
+
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+
+	var chain, elems []string
+	if ci.policy == ForwardedAppend && ci.trusted {
+		chain = ci.chain
+		elems = ci.elems
+		chain = append(chain[:len(chain):len(chain)], ci.peer)
+		elems = append(elems[:len(elems):len(elems)], forwardedElement(ci.peer, in.Host, proto))
+	} else {
+		chain = []string{ci.IP}
+		elems = []string{forwardedElement(ci.IP, ci.Host, ci.Proto)}
+		// backends may believe X-Real-IP as well; only a trusted proxy gets to set it
+		out.Del("X-Real-IP")
+	}
+
+	out.Set("X-Forwarded-For", strings.Join(chain, ", "))
+	out.Set("Forwarded", strings.Join(elems, ", "))
+	out.Set("X-Forwarded-Proto", ci.Proto)
+	out.Set("X-Forwarded-Host", ci.Host)
+}
+
+// forwardedElement renders one Forwarded element, quoting values that aren't tokens
+func forwardedElement(forIP, host, proto string) string {
+	parts := []string{"for=" + quoteForwarded(forwardedNode(forIP))}
+	if host != "" {
+		parts = append(parts, "host="+quoteForwarded(host))
+	}
+	parts = append(parts, "proto="+proto)
+	return strings.Join(parts, ";")
+}
+
+// forwardedNode brackets IPv6 addresses as RFC 7239 requires
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "[" + ip + "]"
+	}
+	return ip
+}
+
+func quoteForwarded(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(c rune) bool {
+	return c < 0x7f && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.ContainsRune("!#$%&'*+-.^_`|~", c))
+}
+
+// parseForwardedElement splits `for=1.2.3.4;proto=https` into lower-cased keys and unquoted values
+func parseForwardedElement(elem string) map[string]string {
+	pairs := make(map[string]string)
+	for _, pair := range strings.Split(elem, ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+			v = strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(v[1 : len(v)-1])
+		}
+		pairs[strings.ToLower(strings.TrimSpace(k))] = v
+	}
+	return pairs
+}
+
+// forwardedNodeIP strips the brackets and port from a Forwarded node ("[2001:db8::1]:443");
+// obfuscated nodes ("_hidden", "unknown") are returned as they are
+func forwardedNodeIP(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+}
+
+// headerList splits comma-separated header values into trimmed, non-empty items.
+// Forwarded values don't contain commas inside quotes in practice, so a plain split is enough.
+func headerList(values []string) []string {
+	var items []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+func firstValue(v string) string {
+	first, _, _ := strings.Cut(v, ",")
+	return strings.TrimSpace(first)
+}
+
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
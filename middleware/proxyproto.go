@@ -0,0 +1,291 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol versions, as accepted by WriteProxyHeader
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyV1Line is the longest possible v1 header, CRLF included
+const maxProxyV1Line = 107
+
+// ProxyProtocolListener reads HAProxy PROXY protocol (v1 or v2) headers from
+// connections whose source is trusted, typically an L4 balancer or cloud NLB,
+// and reports the client address they carry as the connection's RemoteAddr.
+// Connections from elsewhere are passed through untouched, so their headers
+// are never believed; a trusted source may also connect without a header.
+type ProxyProtocolListener struct {
+	net.Listener
+
+	trusted []netip.Prefix
+	// Timeout bounds how long a trusted source may take to send its header
+	Timeout time.Duration
+}
+
+func NewProxyProtocolListener(ln net.Listener, trustedSources []string, timeout time.Duration) (*ProxyProtocolListener, error) {
+	trusted, err := parsePrefixes(trustedSources)
+	if err != nil {
+		return nil, err
+	}
+	if len(trusted) == 0 {
+		return nil, errors.New("PROXY protocol needs at least one trusted source CIDR")
+	}
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &ProxyProtocolListener{Listener: ln, trusted: trusted, Timeout: timeout}, nil
+}
+
+// Accept returns without reading; the header is read on the connection's first
+// Read or RemoteAddr call, in the server goroutine that handles it, so a slow
+// client can't hold up the accept loop
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: c, listener: l}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	listener *ProxyProtocolListener
+
+	once   sync.Once
+	reader io.Reader
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		c.reader, c.remote = c.Conn, c.Conn.RemoteAddr()
+
+		src, ok := c.remote.(*net.TCPAddr)
+		if !ok || !containsAddr(c.listener.trusted, src.AddrPort().Addr()) {
+			return
+		}
+
+		c.Conn.SetReadDeadline(time.Now().Add(c.listener.Timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		br := bufio.NewReader(c.Conn)
+		c.reader = br
+		addr, err := readProxyHeader(br)
+		if err == io.EOF {
+			c.err = err // connected and closed, e.g. a TCP health check
+			return
+		}
+		if err != nil {
+			c.err = fmt.Errorf("PROXY protocol header from %s: %w", c.remote, err)
+			log.Printf("[proxy-protocol] %v", c.err)
+			return
+		}
+		if addr.IsValid() {
+			c.remote = net.TCPAddrFromAddrPort(addr)
+		}
+	})
+}
+
+// Handshake reads the PROXY header now rather than on the first Read, like
+// tls.Conn.Handshake; an error means the connection should be dropped
+func (c *proxyProtocolConn) Handshake() error {
+	c.init()
+	return c.err
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// CloseWrite half-closes the underlying connection when it supports it, so the
+// TCP mode can pass on a clean EOF
+func (c *proxyProtocolConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// readProxyHeader consumes a v1 or v2 header if the stream starts with one and
+// returns the source address it names. The zero AddrPort means "keep the
+// connection's own address": no header, a v2 LOCAL command (e.g. a health
+// check from the balancer itself), or an UNKNOWN / non-TCP source.
+func readProxyHeader(br *bufio.Reader) (netip.AddrPort, error) {
+	// peek one byte at a time so a client that sends less than a full signature isn't blocked
+	first, err := br.Peek(1)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	switch first[0] {
+	case 'P':
+		if sig, err := br.Peek(6); err != nil || string(sig) != "PROXY " {
+			return netip.AddrPort{}, nil
+		}
+		return readProxyV1(br)
+	case proxyV2Signature[0]:
+		if sig, err := br.Peek(len(proxyV2Signature)); err != nil || !bytes.Equal(sig, proxyV2Signature) {
+			return netip.AddrPort{}, nil
+		}
+		return readProxyV2(br)
+	default:
+		return netip.AddrPort{}, nil
+	}
+}
+
+// readProxyV1 parses "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readProxyV1(br *bufio.Reader) (netip.AddrPort, error) {
+	var line []byte
+	for len(line) < maxProxyV1Line {
+		b, err := br.ReadByte()
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return netip.AddrPort{}, errors.New("v1 header too long or not CRLF terminated")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return netip.AddrPort{}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return netip.AddrPort{}, fmt.Errorf("malformed v1 header %q", line)
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid v1 source port %q", fields[4])
+	}
+	return netip.AddrPortFrom(ip.Unmap(), uint16(port)), nil
+}
+
+func readProxyV2(br *bufio.Reader) (netip.AddrPort, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if hdr[12]>>4 != 2 {
+		return netip.AddrPort{}, fmt.Errorf("unsupported v2 version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	switch hdr[12] & 0x0f {
+	case 0x0: // LOCAL
+		return netip.AddrPort{}, nil
+	case 0x1: // PROXY
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unsupported v2 command %d", hdr[12]&0x0f)
+	}
+
+	// address family and transport; anything but TCP keeps the connection's address
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return netip.AddrPort{}, errors.New("short v2 IPv4 address block")
+		}
+		ip := netip.AddrFrom4([4]byte(body[0:4]))
+		return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[8:10])), nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return netip.AddrPort{}, errors.New("short v2 IPv6 address block")
+		}
+		ip := netip.AddrFrom16([16]byte(body[0:16])).Unmap()
+		return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[32:34])), nil
+	default:
+		return netip.AddrPort{}, nil
+	}
+}
+
+// WriteProxyHeader writes a PROXY protocol header for a connection from src to
+// dst. An invalid src (unknown client) is sent as UNKNOWN (v1) or LOCAL (v2).
+func WriteProxyHeader(w io.Writer, version string, src, dst netip.AddrPort) error {
+	known := src.IsValid() && dst.IsValid()
+	if known && src.Addr().Unmap().Is4() != dst.Addr().Unmap().Is4() {
+		// both ends must be in the same family; fall back to IPv6 (v4-mapped)
+		src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	} else if known {
+		src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+		dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	}
+
+	switch version {
+	case ProxyProtocolV1:
+		line := "PROXY UNKNOWN\r\n"
+		if known {
+			family := "TCP4"
+			if !src.Addr().Is4() {
+				family = "TCP6"
+			}
+			line = fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src.Addr(), dst.Addr(), src.Port(), dst.Port())
+		}
+		_, err := io.WriteString(w, line)
+		return err
+
+	case ProxyProtocolV2:
+		buf := append([]byte(nil), proxyV2Signature...)
+		if !known {
+			buf = append(buf, 0x20, 0x00, 0, 0) // v2 LOCAL, unspecified family
+			_, err := w.Write(buf)
+			return err
+		}
+		var addrs []byte
+		if src.Addr().Is4() {
+			s, d := src.Addr().As4(), dst.Addr().As4()
+			buf = append(buf, 0x21, 0x11)
+			addrs = append(append(addrs, s[:]...), d[:]...)
+		} else {
+			s, d := src.Addr().As16(), dst.Addr().As16()
+			buf = append(buf, 0x21, 0x21)
+			addrs = append(append(addrs, s[:]...), d[:]...)
+		}
+		addrs = binary.BigEndian.AppendUint16(addrs, src.Port())
+		addrs = binary.BigEndian.AppendUint16(addrs, dst.Port())
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(addrs)))
+		_, err := w.Write(append(buf, addrs...))
+		return err
+
+	default:
+		return fmt.Errorf("unknown PROXY protocol version %q (want %s or %s)", version, ProxyProtocolV1, ProxyProtocolV2)
+	}
+}
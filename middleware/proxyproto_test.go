@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// proxyV2 builds a v2 header with the given version/command and family/transport bytes
+func proxyV2(verCmd, family byte, body []byte) string {
+	buf := append([]byte(nil), proxyV2Signature...)
+	buf = append(buf, verCmd, family)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(body)))
+	return string(append(buf, body...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4Body := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6Body := make([]byte, 36)
+	copy(ipv6Body, netip.MustParseAddr("2001:db8::1").AsSlice())
+	copy(ipv6Body[16:], netip.MustParseAddr("2001:db8::2").AsSlice())
+	binary.BigEndian.PutUint16(ipv6Body[32:], 56324)
+	binary.BigEndian.PutUint16(ipv6Body[34:], 443)
+
+	tests := []struct {
+		name    string
+		input   string
+		want    string // empty means the connection's own address is kept
+		wantErr bool
+	}{
+		{name: "no header", input: "GET / HTTP/1.1\r\n"},
+		{name: "starts like v1", input: "POST / HTTP/1.1\r\n"},
+		{name: "v1 TCP4", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET", want: "192.0.2.1:56324"},
+		{name: "v1 TCP6", input: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nGET", want: "[2001:db8::1]:56324"},
+		{name: "v1 UNKNOWN", input: "PROXY UNKNOWN\r\nGET"},
+		{name: "v1 UNKNOWN with addresses", input: "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\nGET"},
+		{name: "v1 missing fields", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", wantErr: true},
+		{name: "v1 bad family", input: "PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", wantErr: true},
+		{name: "v1 bad address", input: "PROXY TCP4 192.0.2.999 198.51.100.1 56324 443\r\n", wantErr: true},
+		{name: "v1 bad port", input: "PROXY TCP4 192.0.2.1 198.51.100.1 70000 443\r\n", wantErr: true},
+		{name: "v1 LF only", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\nGET", wantErr: true},
+		{name: "v1 too long", input: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", wantErr: true},
+		{name: "v1 cut off", input: "PROXY TCP4 192.0.2.1", wantErr: true},
+		{name: "v2 PROXY IPv4", input: proxyV2(0x21, 0x11, ipv4Body) + "GET", want: "192.0.2.1:56324"},
+		{name: "v2 PROXY IPv6", input: proxyV2(0x21, 0x21, ipv6Body) + "GET", want: "[2001:db8::1]:56324"},
+		{name: "v2 LOCAL", input: proxyV2(0x20, 0x00, nil) + "GET"},
+		{name: "v2 UDP keeps the address", input: proxyV2(0x21, 0x12, ipv4Body) + "GET"},
+		{name: "v2 with TLVs after the addresses", input: proxyV2(0x21, 0x11, append(ipv4Body, 0x04, 0x00, 0x01, 0x00)) + "GET", want: "192.0.2.1:56324"},
+		{name: "v2 bad version", input: proxyV2(0x11, 0x11, ipv4Body), wantErr: true},
+		{name: "v2 bad command", input: proxyV2(0x22, 0x11, ipv4Body), wantErr: true},
+		{name: "v2 short IPv4 block", input: proxyV2(0x21, 0x11, ipv4Body[:8]), wantErr: true},
+		{name: "v2 body cut off", input: proxyV2(0x21, 0x11, ipv4Body)[:20], wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := bufio.NewReader(strings.NewReader(tt.input))
+			addr, err := readProxyHeader(br)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readProxyHeader() = %v, want error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readProxyHeader() error: %v", err)
+			}
+			got := ""
+			if addr.IsValid() {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("readProxyHeader() = %q, want %q", got, tt.want)
+			}
+
+			// the header, and only the header, is consumed
+			rest, _ := io.ReadAll(br)
+			if tt.want != "" || strings.HasPrefix(tt.input, "PROXY") || strings.HasPrefix(tt.input, string(proxyV2Signature)) {
+				if string(rest) != "GET" {
+					t.Errorf("left %q unread, want %q", rest, "GET")
+				}
+			} else if string(rest) != tt.input {
+				t.Errorf("consumed part of a stream without a header: left %q", rest)
+			}
+		})
+	}
+}
+
+func TestWriteProxyHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst string
+		want     string // empty means no address is carried
+	}{
+		{name: "IPv4", src: "192.0.2.1:56324", dst: "198.51.100.1:443", want: "192.0.2.1:56324"},
+		{name: "IPv6", src: "[2001:db8::1]:56324", dst: "[2001:db8::2]:443", want: "[2001:db8::1]:56324"},
+		{name: "v4-mapped source", src: "[::ffff:192.0.2.1]:56324", dst: "198.51.100.1:443", want: "192.0.2.1:56324"},
+		{name: "mixed families", src: "192.0.2.1:56324", dst: "[2001:db8::2]:443", want: "192.0.2.1:56324"},
+		{name: "unknown source", dst: "198.51.100.1:443"},
+	}
+	for _, version := range []string{ProxyProtocolV1, ProxyProtocolV2} {
+		for _, tt := range tests {
+			t.Run(version+"/"+tt.name, func(t *testing.T) {
+				var src, dst netip.AddrPort
+				if tt.src != "" {
+					src = netip.MustParseAddrPort(tt.src)
+				}
+				dst = netip.MustParseAddrPort(tt.dst)
+
+				var buf bytes.Buffer
+				if err := WriteProxyHeader(&buf, version, src, dst); err != nil {
+					t.Fatal(err)
+				}
+				buf.WriteString("GET")
+
+				br := bufio.NewReader(&buf)
+				addr, err := readProxyHeader(br)
+				if err != nil {
+					t.Fatalf("reading back %q: %v", buf.String(), err)
+				}
+				got := ""
+				if addr.IsValid() {
+					got = addr.String()
+				}
+				if got != tt.want {
+					t.Errorf("round trip = %q, want %q", got, tt.want)
+				}
+				if rest, _ := io.ReadAll(br); string(rest) != "GET" {
+					t.Errorf("left %q unread, want %q", rest, "GET")
+				}
+			})
+		}
+	}
+
+	if err := WriteProxyHeader(io.Discard, "v3", netip.AddrPort{}, netip.AddrPort{}); err == nil {
+		t.Error("WriteProxyHeader accepted an unknown version")
+	}
+}
+
+// TestProxyProtocolHandshake checks that a malformed header from a trusted source
+// surfaces from Handshake, before anything is read from the connection
+func TestProxyProtocolHandshake(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		wantErr    bool
+		wantRemote string
+	}{
+		{name: "valid", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", wantRemote: "192.0.2.1:56324"},
+		{name: "malformed", header: "PROXY TCP4 nonsense\r\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			pln, err := NewProxyProtocolListener(ln, []string{"127.0.0.0/8"}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			client.Write([]byte(tt.header))
+
+			conn, err := pln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			err = conn.(interface{ Handshake() error }).Handshake()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Handshake() succeeded on a malformed header")
+				}
+				if _, err := conn.Read(make([]byte, 1)); err == nil {
+					t.Error("Read succeeded after a failed handshake")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Handshake() error: %v", err)
+			}
+			if got := conn.RemoteAddr().String(); got != tt.wantRemote {
+				t.Errorf("RemoteAddr() = %s, want %s", got, tt.wantRemote)
+			}
+		})
+	}
+}
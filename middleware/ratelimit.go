@@ -2,7 +2,6 @@ package middleware
 
 import (
         "net/http"
-        "strings"
         "sync"
         "time"
 )
@@ -103,18 +102,9 @@ func (rl *RateLimiter) SetLimits(maxRequests int, window time.Duration) {
 
 func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
         return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-                ip := r.RemoteAddr
-                if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-                        parts := strings.Split(forwarded, ",")
-                        if len(parts) > 0 {
-                                ip = strings.TrimSpace(parts[0])
-                        }
-                }
-                if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
-                        ip = realIP
-                }
-
-                if !rl.Allow(ip) {
+                // resolved by Forwarding.Middleware from trusted proxies only, so a
+                // client can't pick its own bucket with a header
+                if !rl.Allow(ClientIP(r)) {
                         w.Header().Set("Content-Type", "application/json")
                         w.Header().Set("Retry-After", "60")
                         w.WriteHeader(http.StatusTooManyRequests)
@@ -125,7 +125,7 @@ func (tc *TLSConfig) GetStats() map[string]interface{} {
 
 func HTTPSRedirectMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get("X-Forwarded-Proto") == "http" {
+		if ci, ok := ClientInfoFrom(r.Context()); ok && ci.Proto == "http" {
 			target := "https://" + r.Host + r.URL.RequestURI()
 			http.Redirect(w, r, target, http.StatusMovedPermanently)
 			return
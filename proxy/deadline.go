@@ -0,0 +1,119 @@
+package proxy
+
+import (
+        "context"
+        "fmt"
+        "io"
+        "net/http"
+        "strconv"
+        "strings"
+        "sync"
+        "time"
+)
+
+var (
+        // ErrAttemptTimeout ends an attempt whose backend didn't send response headers in time
+        ErrAttemptTimeout = fmt.Errorf("backend did not respond within the attempt timeout: %w", context.DeadlineExceeded)
+
+        // ErrIdleTimeout ends a response whose body stopped flowing for longer than the idle timeout
+        ErrIdleTimeout = fmt.Errorf("response body idle for too long: %w", context.DeadlineExceeded)
+)
+
+// DeadlineHeader carries the absolute time by which the backend must have answered (RFC 3339)
+const DeadlineHeader = "X-Request-Deadline"
+
+// setDeadlineHeaders tells the backend how long it has: X-Request-Deadline always,
+// grpc-timeout for gRPC calls (which gRPC servers turn into their own context deadline)
+func setDeadlineHeaders(r *http.Request, deadline time.Time) {
+        r.Header.Set(DeadlineHeader, deadline.UTC().Format(time.RFC3339Nano))
+        if strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+                r.Header.Set("grpc-timeout", FormatGRPCTimeout(time.Until(deadline)))
+        }
+}
+
+// ParseGRPCTimeout parses a grpc-timeout header value such as "250m" or "10S"
+func ParseGRPCTimeout(s string) (time.Duration, error) {
+        if len(s) < 2 || len(s) > 9 {
+                return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+        }
+        n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+        if err != nil || n < 0 {
+                return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+        }
+
+        var unit time.Duration
+        switch s[len(s)-1] {
+        case 'H':
+                unit = time.Hour
+        case 'M':
+                unit = time.Minute
+        case 'S':
+                unit = time.Second
+        case 'm':
+                unit = time.Millisecond
+        case 'u':
+                unit = time.Microsecond
+        case 'n':
+                unit = time.Nanosecond
+        default:
+                return 0, fmt.Errorf("invalid grpc-timeout unit in %q", s)
+        }
+        return time.Duration(n) * unit, nil
+}
+
+// FormatGRPCTimeout renders d in the largest precision that fits gRPC's 8 digit limit
+func FormatGRPCTimeout(d time.Duration) string {
+        if d <= 0 {
+                return "0n"
+        }
+        const maxValue = 99999999
+        units := []struct {
+                suffix string
+                size   time.Duration
+        }{
+                {"n", time.Nanosecond},
+                {"u", time.Microsecond},
+                {"m", time.Millisecond},
+                {"S", time.Second},
+                {"M", time.Minute},
+        }
+        for _, u := range units {
+                // truncate so the backend never gets more time than is left
+                if v := d / u.size; v <= maxValue {
+                        return strconv.FormatInt(int64(v), 10) + u.suffix
+                }
+        }
+        return strconv.FormatInt(int64(d/time.Hour), 10) + "H"
+}
+
+// idleTimeoutBody cancels the attempt when a read from the upstream body
+// hasn't completed for longer than timeout
+type idleTimeoutBody struct {
+        io.ReadCloser
+        timeout time.Duration
+        timer   *time.Timer
+        once    sync.Once
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelCauseFunc) *idleTimeoutBody {
+        return &idleTimeoutBody{
+                ReadCloser: body,
+                timeout:    timeout,
+                timer: time.AfterFunc(timeout, func() {
+                        cancel(ErrIdleTimeout)
+                }),
+        }
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+        n, err := b.ReadCloser.Read(p)
+        if n > 0 {
+                b.timer.Reset(b.timeout)
+        }
+        return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+        b.once.Do(func() { b.timer.Stop() })
+        return b.ReadCloser.Close()
+}
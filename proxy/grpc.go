@@ -0,0 +1,149 @@
+package proxy
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "io"
+        "net/http"
+        "polybalance/backend"
+        "polybalance/metrics"
+        "strconv"
+        "strings"
+        "sync"
+)
+
+// gRPC status codes, indexed by their numeric value
+var grpcCodeNames = []string{
+        "OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED", "NOT_FOUND",
+        "ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED", "FAILED_PRECONDITION",
+        "ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED", "INTERNAL", "UNAVAILABLE", "DATA_LOSS",
+        "UNAUTHENTICATED",
+}
+
+// gRPC status codes the balancer itself reports
+const (
+        GRPCUnknown          = 2
+        GRPCDeadlineExceeded = 4
+        GRPCUnavailable      = 14 // also what a backend reports when it can't serve the call right now
+)
+
+// GRPCCodeName returns the canonical name of a gRPC status code
+func GRPCCodeName(code int) string {
+        if code >= 0 && code < len(grpcCodeNames) {
+                return grpcCodeNames[code]
+        }
+        return strconv.Itoa(code)
+}
+
+// ParseGRPCCodes parses status codes given by name ("UNAVAILABLE") or number ("14")
+func ParseGRPCCodes(list []string) ([]int, error) {
+        var codes []int
+        for _, s := range list {
+                s = strings.TrimSpace(s)
+                if s == "" {
+                        continue
+                }
+                code := -1
+                for i, name := range grpcCodeNames {
+                        if strings.EqualFold(s, name) {
+                                code = i
+                                break
+                        }
+                }
+                if code < 0 {
+                        n, err := strconv.Atoi(s)
+                        if err != nil || n < 0 || n >= len(grpcCodeNames) {
+                                return nil, fmt.Errorf("unknown gRPC status code %q", s)
+                        }
+                        code = n
+                }
+                codes = append(codes, code)
+        }
+        return codes, nil
+}
+
+// IsGRPC reports whether r is a gRPC call
+func IsGRPC(r *http.Request) bool {
+        return isGRPCContentType(r.Header.Get("Content-Type"))
+}
+
+func isGRPCContentType(ct string) bool {
+        return ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+") ||
+                strings.HasPrefix(ct, "application/grpc;")
+}
+
+// grpcTransport sends gRPC calls over HTTP/2 (prior knowledge for http backends,
+// ALPN for https ones) whatever protocol the rest of the traffic uses. Each call
+// is its own stream on a shared connection, so calls are balanced one by one.
+type grpcTransport struct {
+        http http.RoundTripper
+        grpc http.RoundTripper
+
+        // failureCodes are the grpc-status values that count against the backend
+        failureCodes map[int]bool
+}
+
+func (t *grpcTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+        if IsGRPC(r) {
+                return t.grpc.RoundTrip(r)
+        }
+        return t.http.RoundTrip(r)
+}
+
+// grpcStatusBody waits for the end of a gRPC response to read its grpc-status
+// trailer, then records the call's outcome on the backend
+type grpcStatusBody struct {
+        io.ReadCloser
+        resp         *http.Response
+        backend      *backend.Backend
+        failureCodes map[int]bool
+        once         sync.Once
+}
+
+func (b *grpcStatusBody) Read(p []byte) (int, error) {
+        n, err := b.ReadCloser.Read(p)
+        switch {
+        case err == io.EOF:
+                b.once.Do(b.recordStatus)
+        case err != nil && !errors.Is(err, context.Canceled):
+                // the stream broke before the backend sent its status
+                b.once.Do(func() {
+                        b.record(GRPCUnavailable)
+                })
+        }
+        return n, err
+}
+
+func (b *grpcStatusBody) recordStatus() {
+        // a call that fails straight away sends its status with the headers ("trailers-only")
+        status := b.resp.Trailer.Get("Grpc-Status")
+        if status == "" {
+                status = b.resp.Header.Get("Grpc-Status")
+        }
+        code, err := strconv.Atoi(status)
+        if err != nil {
+                // no status at all is a protocol error, which clients see as UNKNOWN
+                code = GRPCUnknown
+        }
+        b.record(code)
+}
+
+func (b *grpcStatusBody) record(code int) {
+        metrics.GRPCResponses.WithLabelValues(b.backend.URL.String(), GRPCCodeName(code)).Inc()
+        if b.failureCodes[code] {
+                b.backend.RecordFailure()
+        } else {
+                b.backend.RecordSuccess()
+        }
+}
+
+// writeGRPCError answers a gRPC call the balancer couldn't forward with a
+// trailers-only response, which gRPC clients turn into a proper status
+func writeGRPCError(w http.ResponseWriter, code int, msg string) {
+        h := w.Header()
+        h.Set("Content-Type", "application/grpc")
+        h.Set("Grpc-Status", strconv.Itoa(code))
+        h.Set("Grpc-Message", msg)
+        w.WriteHeader(http.StatusOK)
+}
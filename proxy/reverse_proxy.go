@@ -1,26 +1,132 @@
 package proxy
 
 import (
+        "context"
+        "errors"
         "fmt"
+        "io"
         "log"
         "net"
         "net/http"
         "net/http/httputil"
+        "net/netip"
         "net/url"
         "polybalance/backend"
+        "polybalance/middleware"
         "sync/atomic"
         "time"
 )
 
 var requestCounter uint64
 
+// ErrCircuitOpen is reported when a request is refused because the backend's circuit is open
+var ErrCircuitOpen = errors.New("backend circuit open")
+
+// UpstreamErrorRecorder is implemented by response writers that want to know why the
+// proxy failed to get a response (refused, reset, timed out, ...) before it writes
+// its own error status, e.g. to decide whether the request can be retried
+type UpstreamErrorRecorder interface {
+        RecordUpstreamError(err error)
+}
+
 type Proxy struct {
         backend *backend.Backend
         proxy   *httputil.ReverseProxy
+
+        // AttemptTimeout bounds the wait for response headers (0 = no limit)
+        AttemptTimeout time.Duration
+        // IdleTimeout aborts a response whose body stalls for this long (0 = no limit)
+        IdleTimeout time.Duration
+        // TunnelIdleTimeout closes an upgraded connection with no traffic for this long (0 = no limit)
+        TunnelIdleTimeout time.Duration
+
+        headerTimer *time.Timer
+        cancel      context.CancelCauseFunc
+}
+
+// Upstream protocols a Builder can speak to backends
+const (
+        UpstreamHTTP1 = "http1" // HTTP/1.1 only
+        UpstreamH2    = "h2"    // HTTP/2 negotiated via ALPN with https backends, HTTP/1.1 otherwise
+        UpstreamH2C   = "h2c"   // HTTP/2 only: ALPN for https backends, prior knowledge for http ones
+)
+
+// Options tunes the reverse proxies and upstream transports a Builder creates
+type Options struct {
+        // FlushInterval is how often buffered response data is flushed to the client;
+        // negative flushes after every write. SSE and responses without a
+        // Content-Length are always flushed immediately.
+        FlushInterval time.Duration
+
+        // UpstreamProtocol is one of UpstreamHTTP1, UpstreamH2 or UpstreamH2C.
+        // HTTP/2 multiplexes all requests to a backend over a few connections.
+        UpstreamProtocol string
+
+        // GRPC sends gRPC calls over HTTP/2 regardless of UpstreamProtocol and
+        // feeds their grpc-status into the circuit breaker
+        GRPC bool
+        // GRPCFailureCodes are the grpc-status values that count as backend failures
+        GRPCFailureCodes []int
+
+        // UpstreamTLS verifies https backends and presents a client certificate (nil = system roots, no client certificate)
+        UpstreamTLS *UpstreamTLS
+
+        // ProxyProtocol sends a PROXY protocol header (middleware.ProxyProtocolV1 or V2)
+        // naming the client on every backend connection; "" sends none
+        ProxyProtocol string
+}
+
+func DefaultOptions() Options {
+        return Options{
+                FlushInterval:    100 * time.Millisecond,
+                UpstreamProtocol: UpstreamHTTP1,
+                GRPCFailureCodes: []int{GRPCUnavailable},
+        }
+}
+
+// Validate rejects unknown protocol names and combinations that can't work
+func (o Options) Validate() error {
+        if err := ValidateUpstreamProtocol(o.UpstreamProtocol); err != nil {
+                return err
+        }
+        switch o.ProxyProtocol {
+        case "", middleware.ProxyProtocolV1, middleware.ProxyProtocolV2:
+        default:
+                return fmt.Errorf("unknown PROXY protocol version %q (want %s or %s)",
+                        o.ProxyProtocol, middleware.ProxyProtocolV1, middleware.ProxyProtocolV2)
+        }
+        if o.ProxyProtocol != "" && (o.GRPC || (o.UpstreamProtocol != "" && o.UpstreamProtocol != UpstreamHTTP1)) {
+                // a PROXY header names one client per connection; HTTP/2 mixes clients on one
+                return errors.New("PROXY protocol to backends requires HTTP/1.1 upstreams without gRPC mode")
+        }
+        return nil
 }
 
-func newUpstreamTransport() *http.Transport {
-        return &http.Transport{
+// ValidateUpstreamProtocol rejects unknown Options.UpstreamProtocol values
+func ValidateUpstreamProtocol(p string) error {
+        switch p {
+        case "", UpstreamHTTP1, UpstreamH2, UpstreamH2C:
+                return nil
+        default:
+                return fmt.Errorf("unknown upstream protocol %q (want %s, %s or %s)", p, UpstreamHTTP1, UpstreamH2, UpstreamH2C)
+        }
+}
+
+// Builder creates backends whose proxies share the same Options
+type Builder struct {
+        opts Options
+}
+
+func NewBuilder(opts Options) *Builder {
+        return &Builder{opts: opts}
+}
+
+var defaultBuilder = NewBuilder(DefaultOptions())
+
+// newUpstreamTransport builds the transport to one backend; host is what its
+// certificate must name when UpstreamTLS verifies it
+func (bl *Builder) newUpstreamTransport(protocol, host string) *http.Transport {
+        t := &http.Transport{
                 DialContext: (&net.Dialer{
                         Timeout:   5 * time.Second,
                         KeepAlive: 30 * time.Second,
@@ -28,31 +134,152 @@ func newUpstreamTransport() *http.Transport {
 
                 TLSHandshakeTimeout: 5 * time.Second,
 
-                ResponseHeaderTimeout: 5 * time.Second,
+                // waiting for response headers is bounded per attempt (Proxy.AttemptTimeout)
+                // so that slow endpoints like exports can be given more time per route
                 ExpectContinueTimeout: 1 * time.Second,
 
                 MaxIdleConns:        100,
                 MaxIdleConnsPerHost: 10,
                 IdleConnTimeout:     90 * time.Second,
         }
+
+        if bl.opts.ProxyProtocol != "" {
+                // the header names one client, so a connection can't be reused for another
+                t.DisableKeepAlives = true
+                dial := t.DialContext
+                version := bl.opts.ProxyProtocol
+                t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+                        conn, err := dial(ctx, network, addr)
+                        if err != nil {
+                                return nil, err
+                        }
+                        src, _ := ctx.Value(proxyProtocolSourceKey{}).(netip.AddrPort)
+                        var dst netip.AddrPort
+                        if tcp, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+                                dst = tcp.AddrPort()
+                        }
+                        if err := middleware.WriteProxyHeader(conn, version, src, dst); err != nil {
+                                conn.Close()
+                                return nil, err
+                        }
+                        return conn, nil
+                }
+        }
+
+        if bl.opts.UpstreamTLS != nil {
+                t.TLSClientConfig = bl.opts.UpstreamTLS.ClientConfig(host)
+                bl.opts.UpstreamTLS.track(t)
+        }
+
+        protocols := new(http.Protocols)
+        switch protocol {
+        case UpstreamH2:
+                protocols.SetHTTP1(true)
+                protocols.SetHTTP2(true)
+        case UpstreamH2C:
+                // without HTTP/1 the transport speaks prior-knowledge HTTP/2 to http:// backends
+                protocols.SetHTTP2(true)
+                protocols.SetUnencryptedHTTP2(true)
+        default:
+                protocols.SetHTTP1(true)
+        }
+        t.Protocols = protocols
+
+        if protocols.HTTP2() || protocols.UnencryptedHTTP2() {
+                // ping idle connections so a dead backend is noticed before requests pile onto it
+                t.HTTP2 = &http.HTTP2Config{
+                        SendPingTimeout: 30 * time.Second,
+                        PingTimeout:     10 * time.Second,
+                }
+        }
+        return t
 }
 
-func NewReverseProxy(rawURL string) *httputil.ReverseProxy {
+func (bl *Builder) NewReverseProxy(rawURL string) (*httputil.ReverseProxy, error) {
         target, err := url.Parse(rawURL)
         if err != nil {
-                log.Fatalf("Invalid backend URL %s: %v", rawURL, err)
+                return nil, fmt.Errorf("invalid backend URL %s: %w", rawURL, err)
+        }
+        proxy := &httputil.ReverseProxy{
+                // Rewrite rather than Director so that ReverseProxy doesn't append its own
+                // X-Forwarded-For: forwarding headers are set from the resolved client only
+                Rewrite: func(pr *httputil.ProxyRequest) {
+                        pr.SetURL(target)
+                        pr.Out.Host = pr.In.Host // backends see the Host the client asked for
+                        middleware.SetForwardingHeaders(pr.Out.Header, pr.In)
+                        if bl.opts.ProxyProtocol != "" {
+                                // tell the dialer who the connection is for
+                                src := proxyProtocolSource(pr.In)
+                                pr.Out = pr.Out.WithContext(context.WithValue(pr.Out.Context(), proxyProtocolSourceKey{}, src))
+                        }
+                },
+        }
+        proxy.Transport = bl.newUpstreamTransport(bl.opts.UpstreamProtocol, target.Hostname())
+        if bl.opts.GRPC {
+                gt := &grpcTransport{
+                        http:         proxy.Transport,
+                        grpc:         proxy.Transport,
+                        failureCodes: make(map[int]bool, len(bl.opts.GRPCFailureCodes)),
+                }
+                if bl.opts.UpstreamProtocol != UpstreamH2C {
+                        gt.grpc = bl.newUpstreamTransport(UpstreamH2C, target.Hostname())
+                }
+                for _, code := range bl.opts.GRPCFailureCodes {
+                        gt.failureCodes[code] = true
+                }
+                proxy.Transport = gt
+        }
+        proxy.FlushInterval = bl.opts.FlushInterval
+        return proxy, nil
+}
+
+// NewBackend builds a backend together with its reverse proxy.
+// It satisfies backend.Factory so the admin API and discovery can create backends at runtime.
+func (bl *Builder) NewBackend(rawURL string, weight int) (*backend.Backend, error) {
+        if err := backend.ValidateURL(rawURL); err != nil {
+                return nil, err
+        }
+        rp, err := bl.NewReverseProxy(rawURL)
+        if err != nil {
+                return nil, err
+        }
+        return backend.NewBackend(rawURL, weight, rp)
+}
+
+// NewReverseProxy builds a reverse proxy with DefaultOptions
+func NewReverseProxy(rawURL string) (*httputil.ReverseProxy, error) {
+        return defaultBuilder.NewReverseProxy(rawURL)
+}
+
+// NewBackend builds a backend with DefaultOptions
+func NewBackend(rawURL string, weight int) (*backend.Backend, error) {
+        return defaultBuilder.NewBackend(rawURL, weight)
+}
+
+type proxyProtocolSourceKey struct{}
+
+// proxyProtocolSource is the client a PROXY header should name: the resolved
+// client IP, with the peer's port when the client connected directly
+func proxyProtocolSource(r *http.Request) netip.AddrPort {
+        ip, err := netip.ParseAddr(middleware.ClientIP(r))
+        if err != nil {
+                return netip.AddrPort{}
+        }
+        if peer, err := netip.ParseAddrPort(r.RemoteAddr); err == nil && peer.Addr().Unmap() == ip.Unmap() {
+                return peer
         }
-        proxy := httputil.NewSingleHostReverseProxy(target)
-        proxy.Transport = newUpstreamTransport()
-        return proxy
+        return netip.AddrPortFrom(ip, 0)
 }
 
 // Reverse proxy is middleware that forwards requests from client to a backend server and returns repsonses from backend to client
 // NewProxy wraps a reverse proxy with LB logic
 func NewProxy(b *backend.Backend) *Proxy {
+        // shallow copy so concurrent requests don't race on the hooks; the transport
+        // (and its connection pool) is still shared
+        rp := *b.Proxy
         p := &Proxy{
                 backend: b,
-                proxy:   b.Proxy,
+                proxy:   &rp,
         }
 
         // Modify requests before forwarding to backend
@@ -62,17 +289,19 @@ func NewProxy(b *backend.Backend) *Proxy {
         return p
 }
 
-// before sending request: add forwarding headers and request ID
+// before sending request: add deadline headers and request ID
+// (forwarding headers are set by the reverse proxy's Rewrite hook)
 func (p *Proxy) prepareRequest(r *http.Request) {
-        // Ensure X-Forwarded-For is set
-        if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-                prior := r.Header.Get("X-Forwarded-For")
-                if prior != "" {
-                        r.Header.Set("X-Forwarded-For", prior+", "+clientIP)
-                } else {
-                        r.Header.Set("X-Forwarded-For", clientIP)
+        // tell the backend when the balancer will give up on it
+        deadline, ok := r.Context().Deadline()
+        if p.AttemptTimeout > 0 {
+                if attemptDeadline := time.Now().Add(p.AttemptTimeout); !ok || attemptDeadline.Before(deadline) {
+                        deadline, ok = attemptDeadline, true
                 }
         }
+        if ok {
+                setDeadlineHeaders(r, deadline)
+        }
 
         // Add request ID if not present
         if r.Header.Get("X-Request-ID") == "" {
@@ -87,6 +316,13 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
         // circuit breaker gate
         if !b.CheckCircuitState() {
+                if rec, ok := w.(UpstreamErrorRecorder); ok {
+                        rec.RecordUpstreamError(ErrCircuitOpen)
+                }
+                if IsGRPC(r) {
+                        writeGRPCError(w, GRPCUnavailable, "backend temporarily unavailable")
+                        return
+                }
                 http.Error(w, "Backend temporarily unavailable", http.StatusServiceUnavailable)
                 return
         }
@@ -96,6 +332,19 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
                 b.SetCircuitHalfOpen()
         }
 
+        if p.AttemptTimeout > 0 || p.IdleTimeout > 0 {
+                ctx, cancel := context.WithCancelCause(r.Context())
+                defer cancel(nil)
+                p.cancel = cancel
+                if p.AttemptTimeout > 0 {
+                        p.headerTimer = time.AfterFunc(p.AttemptTimeout, func() {
+                                cancel(ErrAttemptTimeout)
+                        })
+                        defer p.headerTimer.Stop()
+                }
+                r = r.WithContext(ctx)
+        }
+
         // track active connections
         b.IncConnections()
         start := time.Now()
@@ -109,9 +358,12 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
         // proxy the request
         p.proxy.ServeHTTP(w, r)
 
-        // cleanup after response
+        // cleanup after response; for an upgrade this is when the tunnel closed,
+        // which says nothing about the backend's latency
         elapsed := time.Since(start)
-        b.RecordLatency(elapsed)
+        if !IsUpgrade(r) {
+                b.RecordLatency(elapsed)
+        }
         b.DecConnections()
 
         log.Printf("[PROXY] Request %s completed in %v", requestID, elapsed)
@@ -120,7 +372,32 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (p *Proxy) handleSuccess(resp *http.Response) error {
         b := p.backend
 
-        b.RecordSuccess()
+        // a gRPC call's outcome is in its trailers; record it once the body has been read
+        gt, grpc := p.proxy.Transport.(*grpcTransport)
+        grpc = grpc && isGRPCContentType(resp.Header.Get("Content-Type"))
+        if grpc {
+                resp.Body = &grpcStatusBody{
+                        ReadCloser:   resp.Body,
+                        resp:         resp,
+                        backend:      b,
+                        failureCodes: gt.failureCodes,
+                }
+        } else {
+                b.RecordSuccess()
+        }
+
+        // headers arrived: the attempt timeout is satisfied, the body may take as long
+        // as the request deadline and idle timeout allow
+        if p.headerTimer != nil {
+                p.headerTimer.Stop()
+        }
+        if resp.StatusCode == http.StatusSwitchingProtocols {
+                if rwc, ok := resp.Body.(io.ReadWriteCloser); ok {
+                        resp.Body = newTunnelConn(rwc, b, p.TunnelIdleTimeout)
+                }
+        } else if p.IdleTimeout > 0 {
+                resp.Body = newIdleTimeoutBody(resp.Body, p.IdleTimeout, p.cancel)
+        }
 
         return nil
 }
@@ -128,8 +405,34 @@ func (p *Proxy) handleSuccess(resp *http.Response) error {
 func (p *Proxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
         b := p.backend
 
-        // Record failure for circuit breaker logic
-        b.RecordFailure()
+        // the transport only sees a cancelled context; report why we cancelled it
+        if errors.Is(err, context.Canceled) {
+                if cause := context.Cause(r.Context()); cause != nil {
+                        err = cause
+                }
+        }
 
+        // Record failure for circuit breaker logic; a cancelled request (client gone,
+        // or a hedge that lost the race) says nothing about the backend
+        if !errors.Is(err, context.Canceled) {
+                b.RecordFailure()
+        }
+
+        if rec, ok := w.(UpstreamErrorRecorder); ok {
+                rec.RecordUpstreamError(err)
+        }
+
+        if IsGRPC(r) {
+                if errors.Is(err, context.DeadlineExceeded) {
+                        writeGRPCError(w, GRPCDeadlineExceeded, "backend timed out")
+                } else {
+                        writeGRPCError(w, GRPCUnavailable, "error contacting backend")
+                }
+                return
+        }
+        if errors.Is(err, context.DeadlineExceeded) {
+                http.Error(w, "Backend timed out", http.StatusGatewayTimeout)
+                return
+        }
         http.Error(w, "Error contacting backend server", http.StatusBadGateway)
 }
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+        "io"
+        "net"
+        "polybalance/backend"
+        "sync"
+        "time"
+)
+
+// NewTCPBackend builds a layer-4 backend (tcp://host:port). It has no reverse
+// proxy; connections to it are spliced by SpliceTCP.
+// It satisfies backend.Factory in TCP mode.
+func NewTCPBackend(rawURL string, weight int) (*backend.Backend, error) {
+        if err := backend.ValidateTCPURL(rawURL); err != nil {
+                return nil, err
+        }
+        return backend.NewBackend(rawURL, weight, nil)
+}
+
+// tcpPair closes both ends of a spliced connection together, so an idle timeout
+// or drain deadline firing on the backend side also unblocks the client side
+type tcpPair struct {
+        net.Conn
+        client net.Conn
+}
+
+func (p tcpPair) Close() error {
+        p.client.Close()
+        return p.Conn.Close()
+}
+
+// SpliceTCP copies bytes between client and upstream in both directions until
+// both are done, and returns the byte counts client→upstream and upstream→client.
+// A clean EOF on one side is passed on as a half-close, so request/response
+// protocols that shut down their write side keep working; an error closes both.
+// Like upgraded HTTP tunnels, the connection is closed after idleTimeout without
+// traffic (0 disables it) and at the backend's drain deadline.
+func SpliceTCP(client, upstream net.Conn, b *backend.Backend, idleTimeout time.Duration) (sent, received int64) {
+        t := newTunnelConn(tcpPair{Conn: upstream, client: client}, b, idleTimeout)
+        defer t.Close()
+
+        var wg sync.WaitGroup
+        wg.Add(1)
+        go func() {
+                defer wg.Done()
+                var err error
+                sent, err = io.Copy(t, client)
+                finishCopy(upstream, t, err)
+        }()
+
+        var err error
+        received, err = io.Copy(client, t)
+        finishCopy(client, t, err)
+
+        wg.Wait()
+        return sent, received
+}
+
+// finishCopy half-closes dst after a clean EOF and closes everything otherwise
+func finishCopy(dst net.Conn, t *tunnelConn, err error) {
+        if err == nil {
+                if cw, ok := dst.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+                        return
+                }
+        }
+        t.Close()
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+        "io"
+        "net/http"
+        "polybalance/backend"
+        "strings"
+        "sync"
+        "time"
+)
+
+// IsUpgrade reports whether r asks to switch protocols (WebSocket, h2c, ...)
+func IsUpgrade(r *http.Request) bool {
+        if r.Header.Get("Upgrade") == "" {
+                return false
+        }
+        for _, v := range r.Header.Values("Connection") {
+                for _, token := range strings.Split(v, ",") {
+                        if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+                                return true
+                        }
+                }
+        }
+        return false
+}
+
+// tunnelConn wraps the backend side of an upgraded connection. It closes the
+// tunnel after idleTimeout without traffic in either direction, and once the
+// backend starts draining it gives the tunnel until the drain deadline to end
+// on its own before closing it.
+type tunnelConn struct {
+        io.ReadWriteCloser
+
+        idleTimeout time.Duration
+        idleTimer   *time.Timer
+
+        closeOnce sync.Once
+        done      chan struct{}
+}
+
+func newTunnelConn(rwc io.ReadWriteCloser, b *backend.Backend, idleTimeout time.Duration) *tunnelConn {
+        t := &tunnelConn{
+                ReadWriteCloser: rwc,
+                idleTimeout:     idleTimeout,
+                done:            make(chan struct{}),
+        }
+        if idleTimeout > 0 {
+                t.idleTimer = time.AfterFunc(idleTimeout, func() { t.Close() })
+        }
+        go t.closeOnDrain(b)
+        return t
+}
+
+func (t *tunnelConn) Read(p []byte) (int, error) {
+        n, err := t.ReadWriteCloser.Read(p)
+        if n > 0 {
+                t.touch()
+        }
+        return n, err
+}
+
+func (t *tunnelConn) Write(p []byte) (int, error) {
+        n, err := t.ReadWriteCloser.Write(p)
+        if n > 0 {
+                t.touch()
+        }
+        return n, err
+}
+
+func (t *tunnelConn) Close() error {
+        var err error
+        t.closeOnce.Do(func() {
+                close(t.done)
+                if t.idleTimer != nil {
+                        t.idleTimer.Stop()
+                }
+                err = t.ReadWriteCloser.Close()
+        })
+        return err
+}
+
+func (t *tunnelConn) touch() {
+        if t.idleTimer != nil {
+                t.idleTimer.Reset(t.idleTimeout)
+        }
+}
+
+// closeOnDrain waits for the backend to start draining, then closes the tunnel at
+// the drain deadline. Without a deadline the tunnel may run until it ends by itself.
+func (t *tunnelConn) closeOnDrain(b *backend.Backend) {
+        for {
+                select {
+                case <-t.done:
+                        return
+                case <-b.DrainSignal():
+                }
+
+                st := b.GetDrainStatus()
+                if st.Deadline == nil {
+                        <-t.done
+                        return
+                }
+
+                timer := time.NewTimer(time.Until(*st.Deadline))
+                select {
+                case <-t.done:
+                        timer.Stop()
+                        return
+                case <-timer.C:
+                }
+                if b.IsDraining() {
+                        t.Close()
+                        return
+                }
+                // draining was cancelled in the meantime; wait for the next drain
+        }
+}
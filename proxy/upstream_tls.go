@@ -0,0 +1,283 @@
+package proxy
+
+import (
+        "bytes"
+        "context"
+        "crypto/sha256"
+        "crypto/tls"
+        "crypto/x509"
+        "encoding/base64"
+        "errors"
+        "fmt"
+        "log"
+        "net/http"
+        "os"
+        "strings"
+        "sync"
+        "sync/atomic"
+        "time"
+        "weak"
+)
+
+// UpstreamTLS holds the TLS settings used towards https backends: a CA bundle
+// replacing the system roots, a client certificate for mutual TLS, an SNI
+// override and pinned public keys. The CA bundle and key pair are re-read when
+// their files change, so rotated certificates apply to new connections without
+// a restart.
+type UpstreamTLS struct {
+        CAFile     string
+        CertFile   string
+        KeyFile    string
+        ServerName string
+
+        // pins are SHA-256 hashes of a SubjectPublicKeyInfo somewhere in the backend's chain
+        pins [][sha256.Size]byte
+
+        material atomic.Pointer[tlsMaterial]
+
+        // transports using this config, closed down on reload so that connections
+        // are re-established with the new material; weak so that removed backends
+        // can still be collected
+        mu         sync.Mutex
+        transports []weak.Pointer[http.Transport]
+}
+
+// tlsMaterial is what was loaded from the files, swapped atomically on reload
+type tlsMaterial struct {
+        roots *x509.CertPool
+        cert  *tls.Certificate
+        hash  [sha256.Size]byte
+}
+
+// NewUpstreamTLS loads the files once; pins are base64 SHA-256 SPKI hashes,
+// optionally prefixed with "sha256/" as in HPKP and curl's --pinnedpubkey
+func NewUpstreamTLS(caFile, certFile, keyFile, serverName string, pins []string) (*UpstreamTLS, error) {
+        if (certFile == "") != (keyFile == "") {
+                return nil, errors.New("client certificate and key must be set together")
+        }
+        u := &UpstreamTLS{
+                CAFile:     caFile,
+                CertFile:   certFile,
+                KeyFile:    keyFile,
+                ServerName: serverName,
+        }
+        for _, pin := range pins {
+                raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(pin), "sha256/"))
+                if err != nil || len(raw) != sha256.Size {
+                        return nil, fmt.Errorf("invalid SPKI pin %q: want a base64 SHA-256 hash", pin)
+                }
+                u.pins = append(u.pins, [sha256.Size]byte(raw))
+        }
+
+        m, err := u.load()
+        if err != nil {
+                return nil, err
+        }
+        u.material.Store(m)
+        return u, nil
+}
+
+// load reads the CA bundle and key pair
+func (u *UpstreamTLS) load() (*tlsMaterial, error) {
+        var contents [][]byte
+        m := &tlsMaterial{}
+
+        if u.CAFile != "" {
+                pem, err := os.ReadFile(u.CAFile)
+                if err != nil {
+                        return nil, fmt.Errorf("reading CA bundle: %w", err)
+                }
+                m.roots = x509.NewCertPool()
+                if !m.roots.AppendCertsFromPEM(pem) {
+                        return nil, fmt.Errorf("no certificates found in CA bundle %s", u.CAFile)
+                }
+                contents = append(contents, pem)
+        }
+
+        if u.CertFile != "" {
+                certPEM, err := os.ReadFile(u.CertFile)
+                if err != nil {
+                        return nil, fmt.Errorf("reading client certificate: %w", err)
+                }
+                keyPEM, err := os.ReadFile(u.KeyFile)
+                if err != nil {
+                        return nil, fmt.Errorf("reading client key: %w", err)
+                }
+                cert, err := tls.X509KeyPair(certPEM, keyPEM)
+                if err != nil {
+                        return nil, fmt.Errorf("loading client key pair: %w", err)
+                }
+                m.cert = &cert
+                contents = append(contents, certPEM, keyPEM)
+        }
+
+        m.hash = sha256.Sum256(bytes.Join(contents, []byte{0}))
+        return m, nil
+}
+
+// Run re-reads the files every interval until ctx is done. A change that fails
+// to load (e.g. a certificate written before its key) is logged and the current
+// material kept.
+func (u *UpstreamTLS) Run(ctx context.Context, interval time.Duration) {
+        if u.CAFile == "" && u.CertFile == "" {
+                return
+        }
+        if interval <= 0 {
+                interval = 30 * time.Second
+        }
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+
+        var failed [sha256.Size]byte
+        for {
+                select {
+                case <-ctx.Done():
+                        return
+                case <-ticker.C:
+                }
+
+                m, err := u.load()
+                if err != nil {
+                        // log once per broken state rather than on every tick
+                        if h := sha256.Sum256([]byte(err.Error())); h != failed {
+                                log.Printf("[upstream-tls] keeping current certificates: %v", err)
+                                failed = h
+                        }
+                        continue
+                }
+                failed = [sha256.Size]byte{}
+                if m.hash != u.material.Load().hash {
+                        u.material.Store(m)
+                        log.Printf("[upstream-tls] reloaded CA bundle / client certificate")
+                        u.closeIdleConnections()
+                }
+        }
+}
+
+// track remembers t so a reload can close its idle connections
+func (u *UpstreamTLS) track(t *http.Transport) {
+        u.mu.Lock()
+        u.transports = append(u.transports, weak.Make(t))
+        u.mu.Unlock()
+}
+
+// closeIdleConnections makes tracked transports dial afresh; busy connections
+// are left to finish and are replaced once idle
+func (u *UpstreamTLS) closeIdleConnections() {
+        u.mu.Lock()
+        live := u.transports[:0]
+        for _, wp := range u.transports {
+                if t := wp.Value(); t != nil {
+                        t.CloseIdleConnections()
+                        live = append(live, wp)
+                }
+        }
+        u.transports = live
+        u.mu.Unlock()
+}
+
+// ClientConfig returns the tls.Config for a transport to one backend host. The
+// certificate must name ServerName if set, otherwise host itself (an IP host is
+// matched against IP SANs). It reads the current material on every handshake, so
+// one config serves across reloads.
+func (u *UpstreamTLS) ClientConfig(host string) *tls.Config {
+        cfg := &tls.Config{
+                ServerName: u.ServerName,
+                MinVersion: tls.VersionTLS12,
+        }
+        if u.CertFile != "" {
+                cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+                        return u.material.Load().cert, nil
+                }
+        }
+        if u.CAFile != "" {
+                // the roots may change after the config is built, so verify by hand
+                // in VerifyConnection instead of through RootCAs
+                cfg.InsecureSkipVerify = true
+        }
+        // crypto/tls leaves ConnectionState.ServerName empty for IP hosts, so the
+        // expected name is captured here rather than read back from the handshake
+        name := u.ServerName
+        if name == "" {
+                name = host
+        }
+        cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+                return u.verify(cs, name)
+        }
+        return cfg
+}
+
+// HostTransports returns a RoundTripper for clients that reach every backend, such
+// as health checkers. It keeps one transport per backend host, built by
+// newTransport around that host's ClientConfig.
+func (u *UpstreamTLS) HostTransports(newTransport func(*tls.Config) *http.Transport) http.RoundTripper {
+        return &hostTransports{
+                tls:          u,
+                newTransport: newTransport,
+                byHost:       make(map[string]*http.Transport),
+        }
+}
+
+type hostTransports struct {
+        tls          *UpstreamTLS
+        newTransport func(*tls.Config) *http.Transport
+
+        mu     sync.Mutex
+        byHost map[string]*http.Transport
+}
+
+func (h *hostTransports) RoundTrip(req *http.Request) (*http.Response, error) {
+        host := req.URL.Hostname()
+
+        h.mu.Lock()
+        t, ok := h.byHost[host]
+        if !ok {
+                t = h.newTransport(h.tls.ClientConfig(host))
+                h.tls.track(t)
+                h.byHost[host] = t
+        }
+        h.mu.Unlock()
+
+        return t.RoundTrip(req)
+}
+
+// verify checks the backend's chain against the CA bundle for name, then the pins
+func (u *UpstreamTLS) verify(cs tls.ConnectionState, name string) error {
+        if len(cs.PeerCertificates) == 0 {
+                return errors.New("backend presented no certificate")
+        }
+
+        chains := cs.VerifiedChains
+        if u.CAFile != "" {
+                opts := x509.VerifyOptions{
+                        DNSName:       name,
+                        Roots:         u.material.Load().roots,
+                        Intermediates: x509.NewCertPool(),
+                }
+                for _, cert := range cs.PeerCertificates[1:] {
+                        opts.Intermediates.AddCert(cert)
+                }
+                var err error
+                if chains, err = cs.PeerCertificates[0].Verify(opts); err != nil {
+                        return err
+                }
+        }
+
+        if len(u.pins) == 0 {
+                return nil
+        }
+        // a pin may name the leaf, an intermediate or the root the chain was verified against
+        candidates := cs.PeerCertificates
+        for _, chain := range chains {
+                candidates = append(candidates, chain...)
+        }
+        for _, cert := range candidates {
+                spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+                for _, pin := range u.pins {
+                        if spki == pin {
+                                return nil
+                        }
+                }
+        }
+        return errors.New("backend certificate chain matches no pinned public key")
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+        "crypto/ecdsa"
+        "crypto/elliptic"
+        "crypto/rand"
+        "crypto/tls"
+        "crypto/x509"
+        "crypto/x509/pkix"
+        "encoding/pem"
+        "math/big"
+        "net"
+        "net/http"
+        "net/http/httptest"
+        "os"
+        "path/filepath"
+        "testing"
+        "time"
+)
+
+// testCA signs leaf certificates for the given DNS names and IPs
+type testCA struct {
+        cert *x509.Certificate
+        key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+        t.Helper()
+        key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+        if err != nil {
+                t.Fatal(err)
+        }
+        tmpl := &x509.Certificate{
+                SerialNumber:          big.NewInt(1),
+                Subject:               pkix.Name{CommonName: "test CA"},
+                NotBefore:             time.Now().Add(-time.Hour),
+                NotAfter:              time.Now().Add(time.Hour),
+                IsCA:                  true,
+                KeyUsage:              x509.KeyUsageCertSign,
+                BasicConstraintsValid: true,
+        }
+        der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+        if err != nil {
+                t.Fatal(err)
+        }
+        cert, _ := x509.ParseCertificate(der)
+        return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) writePEM(t *testing.T) string {
+        t.Helper()
+        path := filepath.Join(t.TempDir(), "ca.pem")
+        data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+        if err := os.WriteFile(path, data, 0o600); err != nil {
+                t.Fatal(err)
+        }
+        return path
+}
+
+func (ca *testCA) issue(t *testing.T, dnsNames []string, ips []net.IP) tls.Certificate {
+        t.Helper()
+        key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+        if err != nil {
+                t.Fatal(err)
+        }
+        tmpl := &x509.Certificate{
+                SerialNumber: big.NewInt(2),
+                Subject:      pkix.Name{CommonName: "backend"},
+                NotBefore:    time.Now().Add(-time.Hour),
+                NotAfter:     time.Now().Add(time.Hour),
+                KeyUsage:     x509.KeyUsageDigitalSignature,
+                ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+                DNSNames:     dnsNames,
+                IPAddresses:  ips,
+        }
+        der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+        if err != nil {
+                t.Fatal(err)
+        }
+        return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestUpstreamTLSVerifiesBackendName(t *testing.T) {
+        ca := newTestCA(t)
+        other := newTestCA(t)
+        loopback := []net.IP{net.ParseIP("127.0.0.1")}
+
+        tests := []struct {
+                name       string
+                cert       tls.Certificate
+                serverName string
+                wantErr    bool
+        }{
+                {name: "IP SAN matches the backend", cert: ca.issue(t, nil, loopback)},
+                {name: "certificate for another IP", cert: ca.issue(t, nil, []net.IP{net.ParseIP("10.0.0.9")}), wantErr: true},
+                {name: "certificate for a DNS name only", cert: ca.issue(t, []string{"other.example"}, nil), wantErr: true},
+                {name: "server name override matches", cert: ca.issue(t, []string{"api.internal"}, nil), serverName: "api.internal"},
+                {name: "server name override doesn't match", cert: ca.issue(t, nil, loopback), serverName: "api.internal", wantErr: true},
+                {name: "signed by another CA", cert: other.issue(t, nil, loopback), wantErr: true},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+                        srv.TLS = &tls.Config{Certificates: []tls.Certificate{tt.cert}}
+                        srv.StartTLS()
+                        defer srv.Close()
+
+                        u, err := NewUpstreamTLS(ca.writePEM(t), "", "", tt.serverName, nil)
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        client := &http.Client{Transport: &http.Transport{TLSClientConfig: u.ClientConfig("127.0.0.1")}}
+                        resp, err := client.Get(srv.URL)
+                        if err == nil {
+                                resp.Body.Close()
+                        }
+                        if tt.wantErr && err == nil {
+                                t.Fatal("request succeeded, want the certificate rejected")
+                        }
+                        if !tt.wantErr && err != nil {
+                                t.Fatalf("request failed: %v", err)
+                        }
+                })
+        }
+}
+
+// TestUpstreamTLSHostTransports checks that a shared client verifies each backend
+// against its own host
+func TestUpstreamTLSHostTransports(t *testing.T) {
+        ca := newTestCA(t)
+        srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+        srv.TLS = &tls.Config{Certificates: []tls.Certificate{ca.issue(t, []string{"localhost"}, nil)}}
+        srv.StartTLS()
+        defer srv.Close()
+
+        u, err := NewUpstreamTLS(ca.writePEM(t), "", "", "", nil)
+        if err != nil {
+                t.Fatal(err)
+        }
+        client := &http.Client{Transport: u.HostTransports(func(c *tls.Config) *http.Transport {
+                return &http.Transport{TLSClientConfig: c}
+        })}
+
+        _, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+        if resp, err := client.Get("https://localhost:" + port); err != nil {
+                t.Fatalf("request to localhost failed: %v", err)
+        } else {
+                resp.Body.Close()
+        }
+        if resp, err := client.Get("https://127.0.0.1:" + port); err == nil {
+                resp.Body.Close()
+                t.Fatal("request to 127.0.0.1 succeeded with a certificate for localhost only")
+        }
+}
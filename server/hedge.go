@@ -0,0 +1,272 @@
+package server
+
+import (
+        "context"
+        "fmt"
+        "net/http"
+        "polybalance/backend"
+        "polybalance/metrics"
+        "polybalance/strategy"
+        "sort"
+        "sync"
+        "time"
+)
+
+const (
+        // latencyWindowSize is how many recent response times a hedge policy keeps
+        latencyWindowSize = 512
+        // minLatencySamples is how many samples a percentile delay needs before it's trusted
+        minLatencySamples = 20
+)
+
+// HedgePolicy sends a second copy of a slow request to another backend. The
+// delay is fixed, or the given percentile of how long the route's backends
+// recently took to send response headers (with Delay as the fallback until
+// enough samples exist; without one, slow requests aren't hedged until then).
+// In a routes file:
+//
+//	"hedge": {"percentile": 95, "delay": "100ms", "min_delay": "10ms"}
+type HedgePolicy struct {
+        Delay      string  `json:"delay"`
+        Percentile float64 `json:"percentile"`
+        MinDelay   string  `json:"min_delay"`
+
+        delay    time.Duration
+        minDelay time.Duration
+        latency  latencyWindow
+}
+
+func (h *HedgePolicy) compile() error {
+        if h.Percentile < 0 || h.Percentile >= 100 {
+                return fmt.Errorf("percentile must be between 0 and 100")
+        }
+        if h.Delay == "" && h.Percentile == 0 {
+                return fmt.Errorf("either delay or percentile is required")
+        }
+
+        var err error
+        if h.Delay != "" {
+                if h.delay, err = time.ParseDuration(h.Delay); err != nil || h.delay < 0 {
+                        return fmt.Errorf("invalid delay %q", h.Delay)
+                }
+        }
+        if h.MinDelay != "" {
+                if h.minDelay, err = time.ParseDuration(h.MinDelay); err != nil || h.minDelay < 0 {
+                        return fmt.Errorf("invalid min_delay %q", h.MinDelay)
+                }
+        }
+        return nil
+}
+
+// hedgeDelay returns how long to wait for the first backend before hedging;
+// ok is false while a percentile-only policy is still collecting samples
+func (h *HedgePolicy) hedgeDelay() (d time.Duration, ok bool) {
+        d = h.delay
+        if h.Percentile > 0 {
+                p, warm := h.latency.percentile(h.Percentile)
+                switch {
+                case warm:
+                        d = p
+                case h.Delay == "":
+                        return 0, false
+                }
+        }
+        if d < h.minDelay {
+                d = h.minDelay
+        }
+        return d, true
+}
+
+// latencyWindow is a ring of recent response times with a cached, lazily
+// recomputed percentile so the hot path doesn't sort on every request
+type latencyWindow struct {
+        mu      sync.Mutex
+        samples [latencyWindowSize]time.Duration
+        n       int
+        next    int
+
+        stale  int // samples added since the cache was computed
+        cacheP float64
+        cacheV time.Duration
+}
+
+func (lw *latencyWindow) record(d time.Duration) {
+        lw.mu.Lock()
+        lw.samples[lw.next] = d
+        lw.next = (lw.next + 1) % latencyWindowSize
+        if lw.n < latencyWindowSize {
+                lw.n++
+        }
+        lw.stale++
+        lw.mu.Unlock()
+}
+
+func (lw *latencyWindow) percentile(p float64) (time.Duration, bool) {
+        lw.mu.Lock()
+        defer lw.mu.Unlock()
+
+        if lw.n < minLatencySamples {
+                return 0, false
+        }
+        if lw.cacheP == p && lw.stale < lw.n/10+1 {
+                return lw.cacheV, true
+        }
+
+        sorted := make([]time.Duration, lw.n)
+        copy(sorted, lw.samples[:lw.n])
+        sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+        idx := int(p / 100 * float64(lw.n))
+        if idx >= lw.n {
+                idx = lw.n - 1
+        }
+        lw.cacheP, lw.cacheV, lw.stale = p, sorted[idx], 0
+        return lw.cacheV, true
+}
+
+// hedgeRace lets concurrent attempts compete for the client's ResponseWriter.
+// The first attempt to commit a response wins and every other attempt is cancelled.
+type hedgeRace struct {
+        mu      sync.Mutex
+        winner  *attemptWriter
+        cancels map[*attemptWriter]context.CancelFunc
+}
+
+func newHedgeRace() *hedgeRace {
+        return &hedgeRace{cancels: make(map[*attemptWriter]context.CancelFunc)}
+}
+
+// add registers an attempt; one added after the race was claimed is cancelled at once
+func (hr *hedgeRace) add(aw *attemptWriter, cancel context.CancelFunc) {
+        hr.mu.Lock()
+        hr.cancels[aw] = cancel
+        claimed := hr.winner != nil
+        hr.mu.Unlock()
+        if claimed {
+                cancel()
+        }
+}
+
+// claimed reports whether some attempt already committed its response
+func (hr *hedgeRace) claimed() bool {
+        hr.mu.Lock()
+        defer hr.mu.Unlock()
+        return hr.winner != nil
+}
+
+// claim returns true if aw is the first attempt to commit, and cancels the others
+func (hr *hedgeRace) claim(aw *attemptWriter) bool {
+        hr.mu.Lock()
+        defer hr.mu.Unlock()
+        if hr.winner != nil {
+                return hr.winner == aw
+        }
+        hr.winner = aw
+        for other, cancel := range hr.cancels {
+                if other != aw {
+                        cancel()
+                }
+        }
+        return true
+}
+
+// serveHedged sends r to one backend and, if it hasn't answered within the
+// hedge delay (or failed in a retryable way), to a second untried backend.
+// The first non-retryable response goes to the client.
+func (s *Server) serveHedged(w http.ResponseWriter, r *http.Request, hedge *HedgePolicy,
+        policy *RetryPolicy, timeouts TimeoutPolicy, backends []*backend.Backend, body []byte) {
+
+        strat := s.StrategyController.Current()
+        race := newHedgeRace()
+        done := make(chan *attemptWriter, 2)
+        start := time.Now()
+
+        tried := make(map[*backend.Backend]bool, 2)
+        inflight := 0
+        launch := func(b *backend.Backend) *attemptWriter {
+                tried[b] = true
+                inflight++
+                ctx, cancel := context.WithCancel(r.Context())
+                aw := newAttemptWriter(w, policy)
+                aw.race = race
+                race.add(aw, cancel)
+                go func() {
+                        defer cancel()
+                        newProxy(b, timeouts).ServeHTTP(aw, attemptRequest(ctx, r, body))
+                        done <- aw
+                }()
+                return aw
+        }
+
+        // hedgeNow launches the second copy if a backend and the budget allow it
+        hedged := false
+        hedgeNow := func() {
+                hedged = true
+                if r.Context().Err() != nil {
+                        return // attempts in flight are ending with the request
+                }
+                if race.claimed() {
+                        return // the first backend is already streaming its response
+                }
+                b := strategy.NextBackendForKey(strat, untried(backends, tried), s.hashKey(r))
+                if b == nil {
+                        return
+                }
+                if !s.HedgeBudget.Withdraw() {
+                        metrics.HedgeBudgetExhausted.Inc()
+                        return
+                }
+                metrics.Hedges.WithLabelValues(b.URL.String()).Inc()
+                launch(b)
+        }
+
+        first := strategy.NextBackendForKey(strat, backends, s.hashKey(r))
+        if first == nil {
+                http.Error(w, "No backend available", http.StatusServiceUnavailable)
+                return
+        }
+        primary := launch(first)
+
+        // a nil channel never fires: no timed hedge until the policy has a delay
+        var hedgeTimer <-chan time.Time
+        if delay, ok := hedge.hedgeDelay(); ok {
+                timer := time.NewTimer(delay)
+                defer timer.Stop()
+                hedgeTimer = timer.C
+        }
+
+        var last *attemptWriter
+        for inflight > 0 {
+                select {
+                case aw := <-done:
+                        inflight--
+                        if aw.lost {
+                                continue // the winner reports separately
+                        }
+                        if !aw.retryable() {
+                                // only the first backend's own time to headers feeds the
+                                // percentile; a hedged win would drag it down and the body's
+                                // length has nothing to do with how long to wait
+                                if aw == primary {
+                                        hedge.latency.record(aw.headersAt.Sub(start))
+                                }
+                                return
+                        }
+                        last = aw
+                        // failed fast: don't wait for the timer
+                        if !hedged {
+                                hedgeNow()
+                        }
+                case <-hedgeTimer:
+                        if !hedged {
+                                hedgeNow()
+                        }
+                }
+        }
+
+        if last == nil {
+                http.Error(w, "No backend available", http.StatusServiceUnavailable)
+                return
+        }
+        last.release()
+}
@@ -1,20 +1,53 @@
 package server
 
 import (
+        "context"
         "fmt"
         "net/http"
         "polybalance/backend"
+        "polybalance/metrics"
+        "polybalance/middleware"
         "polybalance/proxy"
+        "polybalance/strategy"
+        "strings"
+        "time"
 )
 
 type Server struct {
-        Backends           []*backend.Backend
+        Pool               *backend.BackendPool
         StrategyController *StrategyController
-}
 
-const (
-        maxRetries = 2
-)
+        // Routes restrict matching requests to a labelled subset of backends
+        Routes []*Route
+
+        // RetryBodyLimit is the largest request body buffered for replay; larger
+        // requests get a single attempt
+        RetryBodyLimit int64
+
+        // RetryPolicy applies to requests whose route doesn't set its own
+        RetryPolicy *RetryPolicy
+
+        // RetryBudget caps retries to a share of traffic; RetryBackoff spaces them out
+        RetryBudget  *RetryBudget
+        RetryBackoff RetryBackoff
+
+        // HedgeBudget caps the extra requests sent by routes with a hedge policy
+        HedgeBudget *RetryBudget
+
+        // MaxTunnelsPerBackend limits upgraded connections per backend (0 = unlimited);
+        // TunnelIdleTimeout closes tunnels without traffic (0 = never)
+        MaxTunnelsPerBackend int
+        TunnelIdleTimeout    time.Duration
+
+        // HashHeader names the request header consistent_hash keys on; requests
+        // without it (or with it unset) are keyed by client IP
+        HashHeader string
+
+        // Timeouts apply to requests whose route doesn't override them;
+        // MaxClientTimeout caps deadlines requested by clients (0 ignores them)
+        Timeouts         *TimeoutPolicy
+        MaxClientTimeout time.Duration
+}
 
 func (s *Server) RegisterHealthEndpoints(mux *http.ServeMux) {
 
@@ -24,7 +57,7 @@ func (s *Server) RegisterHealthEndpoints(mux *http.ServeMux) {
         })
 
         mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
-                if len(s.Backends) == 0 {
+                if s.Pool.Len() == 0 {
                         http.Error(w, "no backends available", http.StatusServiceUnavailable)
                         return
                 }
@@ -33,95 +66,149 @@ func (s *Server) RegisterHealthEndpoints(mux *http.ServeMux) {
         })
 }
 
-func isRetryableMethod(method string) bool {
-        switch method {
-        case http.MethodGet, http.MethodHead, http.MethodOptions:
-                return true
-        default:
-                return false
+// NewServer creates a new HTTP server with the given backend pool and strategy controller.
+// The pool may start empty when backends come from service discovery.
+func NewServer(pool *backend.BackendPool, stratCtrl *StrategyController) (*Server, error) {
+        if pool == nil {
+                return nil, fmt.Errorf("no backend pool provided")
         }
-}
 
-func isRetryableStatus(code int) bool {
-        switch code {
-        case http.StatusBadGateway,
-                http.StatusServiceUnavailable,
-                http.StatusGatewayTimeout:
-                return true
-        default:
-                return false
+        s := &Server{
+                Pool:               pool,
+                StrategyController: stratCtrl,
+                RetryBodyLimit:     defaultRetryBodyLimit,
+                RetryPolicy:        defaultRetryPolicy(),
+                RetryBudget:        NewRetryBudget(20, 3),
+                RetryBackoff:       RetryBackoff{Base: 25 * time.Millisecond, Max: 250 * time.Millisecond},
+                HedgeBudget:        NewRetryBudget(10, 1),
+                Timeouts:           NewTimeoutPolicy(0, 5*time.Second, 0),
+                MaxClientTimeout:   time.Minute,
         }
+        return s, nil
 }
 
-type responseRecorder struct {
-        http.ResponseWriter
-        status int
-}
-
-func (r *responseRecorder) WriteHeader(code int) {
-        r.status = code
-        r.ResponseWriter.WriteHeader(code)
+// hashKey is what keyed strategies such as consistent_hash map to a backend: the
+// HashHeader value when the request has one, otherwise the resolved client IP
+func (s *Server) hashKey(r *http.Request) string {
+        if s.HashHeader != "" {
+                if v := r.Header.Get(s.HashHeader); v != "" {
+                        return v
+                }
+        }
+        return middleware.ClientIP(r)
 }
 
-func (r *responseRecorder) Write(b []byte) (int, error) {
-        if r.status == 0 {
-                r.status = http.StatusOK
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+        strat := s.StrategyController.Current()
+        route := s.matchRoute(r)
+        backends := candidates(route, s.Pool.Snapshot())
+        if route != nil && len(backends) == 0 {
+                http.Error(w, "No backend matches route "+route.Name, http.StatusServiceUnavailable)
+                return
         }
-        return r.ResponseWriter.Write(b)
-}
 
-// NewServer creates a new HTTP server with the given backends and strategy controller
-func NewServer(backends []*backend.Backend, stratCtrl *StrategyController) (*Server, error) {
-        if len(backends) == 0 {
-                return nil, fmt.Errorf("no backends provided")
+        timeouts := s.timeoutsFor(route)
+
+        // upgrades become long-lived tunnels: no retries, no request deadline
+        if proxy.IsUpgrade(r) {
+                s.serveUpgrade(w, r, backends, timeouts)
+                return
         }
 
-        s := &Server{
-                Backends:           backends,
-                StrategyController: stratCtrl,
+        if d := s.requestTimeout(r, timeouts); d > 0 {
+                ctx, cancel := context.WithTimeout(r.Context(), d)
+                defer cancel()
+                r = r.WithContext(ctx)
         }
-        return s, nil
-}
 
-func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-        strat := s.StrategyController.Current()
+        s.RetryBudget.Deposit()
 
-        // Non-idempotent → single attempt only
-        if !isRetryableMethod(r.Method) {
-                b := strat.NextBackend(s.Backends)
+        // requests that can't safely be repeated, and streams, get a single attempt
+        // written straight to the client
+        policy := s.retryPolicy(route)
+        hedging := route != nil && route.Hedge != nil
+        if (policy.MaxRetries == 0 && !hedging) || isStreaming(r, route) ||
+                !policy.allowsMethod(r, route != nil && route.Idempotent) {
+                b := strategy.NextBackendForKey(strat, backends, s.hashKey(r))
                 if b == nil {
                         http.Error(w, "No backend available", http.StatusServiceUnavailable)
                         return
                 }
-                proxy := proxy.NewProxy(b)
-                proxy.ServeHTTP(w, r)
+                newProxy(b, timeouts).ServeHTTP(w, r)
+                return
+        }
+
+        body, replayable, err := bufferBody(r, s.RetryBodyLimit)
+        if err != nil {
+                http.Error(w, "Error reading request body", bodyReadStatus(err))
                 return
         }
+        attempts := policy.MaxRetries + 1
+        if !replayable {
+                attempts = 1 // body too large to replay
+        }
 
-        var lastStatus int
+        if hedging && replayable {
+                s.HedgeBudget.Deposit()
+                s.serveHedged(w, r, route.Hedge, policy, timeouts, backends, body)
+                return
+        }
 
-        for attempt := 0; attempt <= maxRetries; attempt++ {
+        tried := make(map[*backend.Backend]bool, attempts)
+        var last *attemptWriter
 
-                b := strat.NextBackend(s.Backends)
+        for attempt := 0; attempt < attempts; attempt++ {
+                if r.Context().Err() != nil {
+                        break // client went away or the request deadline passed
+                }
+
+                // retries go to a backend that hasn't failed this request yet
+                b := strategy.NextBackendForKey(strat, untried(backends, tried), s.hashKey(r))
                 if b == nil {
-                        http.Error(w, "No backend available", http.StatusServiceUnavailable)
-                        return
+                        break
                 }
 
-                rec := &responseRecorder{ResponseWriter: w}
+                if attempt > 0 {
+                        if !s.RetryBudget.Withdraw() {
+                                metrics.RetryBudgetExhausted.Inc()
+                                break
+                        }
+                        if !s.RetryBackoff.Wait(r.Context(), attempt) {
+                                break
+                        }
+                        metrics.Retries.WithLabelValues(b.URL.String()).Inc()
+                }
+                tried[b] = true
 
-                p := proxy.NewProxy(b)
-                p.ServeHTTP(rec, r)
+                aw := newAttemptWriter(w, policy)
+                newProxy(b, timeouts).ServeHTTP(aw, attemptRequest(r.Context(), r, body))
 
-                // Success or non-retryable failure → send response
-                if !isRetryableStatus(rec.status) {
-                        if rec.status != 0 {
-                                w.WriteHeader(rec.status)
-                        }
+                // success or non-retryable failure was already streamed to the client
+                if !aw.retryable() {
                         return
                 }
-                lastStatus = rec.status
+                last = aw
         }
 
-        http.Error(w, "Request failed after retries", lastStatus)
+        if last == nil {
+                http.Error(w, "No backend available", http.StatusServiceUnavailable)
+                return
+        }
+        // every attempt failed: the client sees the last backend's response, once
+        last.release()
+}
+
+// isStreaming reports whether r expects a long-lived streamed response or sends a
+// streamed body; neither can be buffered for a retry
+func isStreaming(r *http.Request, rt *Route) bool {
+        if rt != nil && rt.Streaming || proxy.IsGRPC(r) {
+                return true
+        }
+        for _, accept := range r.Header.Values("Accept") {
+                if strings.Contains(accept, "text/event-stream") {
+                        return true
+                }
+        }
+        // chunked upload of unknown length
+        return r.ContentLength < 0 && r.Body != nil && r.Body != http.NoBody
 }
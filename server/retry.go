@@ -0,0 +1,234 @@
+package server
+
+import (
+        "bytes"
+        "context"
+        "errors"
+        "io"
+        "net/http"
+        "polybalance/backend"
+        "time"
+)
+
+const (
+        // defaultRetryBodyLimit is how much of a request body is buffered for replay on retries
+        defaultRetryBodyLimit = 1 << 20
+
+        // maxHeldErrorBytes caps the body of a retryable error response held back while
+        // deciding whether to retry; larger responses are committed as they are
+        maxHeldErrorBytes = 64 * 1024
+)
+
+// attemptWriter sits between the reverse proxy and the client for one attempt.
+// Non-retryable responses are committed to the client as soon as their status is
+// known and then stream through. Responses the retry policy considers retryable
+// are held back in memory so the server can try another backend; only the last
+// one is ever sent.
+type attemptWriter struct {
+        w      http.ResponseWriter
+        policy *RetryPolicy
+        header http.Header
+        status int
+
+        // upstreamErr is why the proxy got no response, if it didn't
+        upstreamErr error
+
+        committed bool         // headers sent to the client; nothing can be retried any more
+        held      bool         // retryable response being held back
+        body      bytes.Buffer // held response body
+
+        // race is set when attempts run concurrently (hedging); only the attempt
+        // that claims it first reaches the client, the others are discarded
+        race *hedgeRace
+        lost bool
+        // headersAt is when the final response status arrived, for hedge delays
+        headersAt time.Time
+}
+
+func newAttemptWriter(w http.ResponseWriter, policy *RetryPolicy) *attemptWriter {
+        return &attemptWriter{
+                w:      w,
+                policy: policy,
+                header: make(http.Header),
+        }
+}
+
+// RecordUpstreamError implements proxy.UpstreamErrorRecorder
+func (a *attemptWriter) RecordUpstreamError(err error) {
+        a.upstreamErr = err
+}
+
+func (a *attemptWriter) Header() http.Header {
+        if a.committed && !a.lost {
+                // trailers are set on the header map after the body
+                return a.w.Header()
+        }
+        return a.header
+}
+
+func (a *attemptWriter) WriteHeader(code int) {
+        if a.status != 0 {
+                return
+        }
+
+        // informational responses (e.g. 103 Early Hints) go straight through,
+        // except while racing where it isn't yet known whose response the client gets
+        if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+                if a.race == nil {
+                        a.writeInformational(code)
+                }
+                return
+        }
+
+        a.status = code
+        a.headersAt = time.Now()
+        if a.policy.retryable(code, a.upstreamErr) {
+                a.held = true
+                return
+        }
+        a.commit()
+}
+
+// writeInformational sends a 1xx response with the attempt's headers, then puts the
+// client's header map back so they don't leak into the final response
+func (a *attemptWriter) writeInformational(code int) {
+        dst := a.w.Header()
+        saved := make(http.Header, len(a.header))
+        for k := range a.header {
+                saved[k] = dst[k]
+        }
+        copyHeader(dst, a.header)
+        a.w.WriteHeader(code)
+        for k, vv := range saved {
+                if vv == nil {
+                        dst.Del(k)
+                } else {
+                        dst[k] = vv
+                }
+        }
+}
+
+func (a *attemptWriter) Write(p []byte) (int, error) {
+        if a.status == 0 {
+                a.WriteHeader(http.StatusOK)
+        }
+        if a.lost {
+                return len(p), nil // another attempt won the race
+        }
+        if !a.held {
+                return a.w.Write(p)
+        }
+
+        if a.body.Len()+len(p) > maxHeldErrorBytes {
+                // too large to keep around: give up on retrying and stream it
+                if err := a.release(); err != nil {
+                        return 0, err
+                }
+                return a.w.Write(p)
+        }
+        return a.body.Write(p)
+}
+
+// Flush implements http.Flusher so streamed responses reach the client as they
+// arrive; a held-back response has nothing the client should see yet
+func (a *attemptWriter) Flush() {
+        if !a.committed || a.lost || a.held {
+                return
+        }
+        http.NewResponseController(a.w).Flush()
+}
+
+// retryable reports whether the attempt ended with a held-back retryable response
+func (a *attemptWriter) retryable() bool {
+        return a.held
+}
+
+// release sends a held-back response to the client
+func (a *attemptWriter) release() error {
+        if !a.held {
+                return nil
+        }
+        a.held = false
+        a.commit()
+        if a.lost {
+                return nil
+        }
+        _, err := a.w.Write(a.body.Bytes())
+        a.body.Reset()
+        return err
+}
+
+func (a *attemptWriter) commit() {
+        a.committed = true
+        if a.race != nil && !a.race.claim(a) {
+                a.lost = true
+                return
+        }
+        copyHeader(a.w.Header(), a.header)
+        a.w.WriteHeader(a.status)
+}
+
+func copyHeader(dst, src http.Header) {
+        for k, vv := range src {
+                dst[k] = vv
+        }
+}
+
+// bufferBody reads the request body into memory so every attempt can replay it.
+// It returns replayable=false when the body exceeds limit; r.Body is then rewired
+// to still yield the complete body once, so a single attempt can be made.
+func bufferBody(r *http.Request, limit int64) (body []byte, replayable bool, err error) {
+        if r.Body == nil || r.Body == http.NoBody {
+                return nil, true, nil
+        }
+
+        buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+        if err != nil {
+                return nil, false, err
+        }
+        if int64(len(buf)) > limit {
+                r.Body = struct {
+                        io.Reader
+                        io.Closer
+                }{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+                return nil, false, nil
+        }
+        r.Body.Close()
+        return buf, true, nil
+}
+
+// attemptRequest clones r for one attempt so header rewrites (X-Forwarded-For, ...)
+// don't accumulate across retries, and gives it a fresh reader over the buffered body
+func attemptRequest(ctx context.Context, r *http.Request, body []byte) *http.Request {
+        out := r.Clone(ctx)
+        if body != nil {
+                out.Body = io.NopCloser(bytes.NewReader(body))
+                out.GetBody = func() (io.ReadCloser, error) {
+                        return io.NopCloser(bytes.NewReader(body)), nil
+                }
+        }
+        return out
+}
+
+// untried returns the backends that haven't been attempted yet
+func untried(backends []*backend.Backend, tried map[*backend.Backend]bool) []*backend.Backend {
+        if len(tried) == 0 {
+                return backends
+        }
+        out := make([]*backend.Backend, 0, len(backends))
+        for _, b := range backends {
+                if !tried[b] {
+                        out = append(out, b)
+                }
+        }
+        return out
+}
+
+// bodyReadStatus maps a failure to read the client's body to a response status
+func bodyReadStatus(err error) int {
+        var tooLarge *http.MaxBytesError
+        if errors.As(err, &tooLarge) {
+                return http.StatusRequestEntityTooLarge
+        }
+        return http.StatusBadRequest
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+        "context"
+        "math/rand"
+        "sync"
+        "time"
+)
+
+// RetryBudget is a token bucket that caps retries to a share of recent traffic,
+// so an outage can't turn every request into maxRetries+1 upstream requests.
+// Every request deposits Ratio tokens, tokens also accrue at MinPerSecond so
+// low-traffic services can still retry, and each retry withdraws one token.
+type RetryBudget struct {
+        ratio        float64
+        minPerSecond float64
+        capacity     float64
+
+        mu     sync.Mutex
+        tokens float64
+        last   time.Time
+}
+
+// NewRetryBudget allows retries up to percent% of requests plus minPerSecond retries
+// per second. The bucket holds at most ten seconds' worth of either source, which
+// bounds the burst of retries at the start of an outage.
+func NewRetryBudget(percent float64, minPerSecond float64) *RetryBudget {
+        if percent < 0 {
+                percent = 0
+        }
+        if minPerSecond < 0 {
+                minPerSecond = 0
+        }
+        capacity := 10 * minPerSecond
+        if capacity < 10 {
+                capacity = 10
+        }
+        return &RetryBudget{
+                ratio:        percent / 100,
+                minPerSecond: minPerSecond,
+                capacity:     capacity,
+                tokens:       capacity,
+                last:         time.Now(),
+        }
+}
+
+// Deposit records one incoming request
+func (rb *RetryBudget) Deposit() {
+        rb.mu.Lock()
+        defer rb.mu.Unlock()
+        rb.refill()
+        rb.tokens += rb.ratio
+        if rb.tokens > rb.capacity {
+                rb.tokens = rb.capacity
+        }
+}
+
+// Withdraw takes a token for one retry; false means the budget is exhausted
+func (rb *RetryBudget) Withdraw() bool {
+        rb.mu.Lock()
+        defer rb.mu.Unlock()
+        rb.refill()
+        if rb.tokens < 1 {
+                return false
+        }
+        rb.tokens--
+        return true
+}
+
+// Available returns the current number of whole retries the budget allows
+func (rb *RetryBudget) Available() int {
+        rb.mu.Lock()
+        defer rb.mu.Unlock()
+        rb.refill()
+        return int(rb.tokens)
+}
+
+// refill adds the time-based tokens; callers hold mu
+func (rb *RetryBudget) refill() {
+        now := time.Now()
+        rb.tokens += now.Sub(rb.last).Seconds() * rb.minPerSecond
+        if rb.tokens > rb.capacity {
+                rb.tokens = rb.capacity
+        }
+        rb.last = now
+}
+
+// RetryBackoff spaces retries out with capped exponential backoff and full jitter
+type RetryBackoff struct {
+        Base time.Duration
+        Max  time.Duration
+}
+
+// Delay returns the wait before the given retry (1 = first retry): a random
+// duration between zero and min(Max, Base * 2^(retry-1))
+func (bo RetryBackoff) Delay(retry int) time.Duration {
+        if bo.Base <= 0 || retry < 1 {
+                return 0
+        }
+        ceiling := bo.Base
+        for i := 1; i < retry && (bo.Max <= 0 || ceiling < bo.Max); i++ {
+                ceiling *= 2
+        }
+        if bo.Max > 0 && ceiling > bo.Max {
+                ceiling = bo.Max
+        }
+        return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// Wait sleeps for Delay(retry); it returns false if ctx ends first
+func (bo RetryBackoff) Wait(ctx context.Context, retry int) bool {
+        d := bo.Delay(retry)
+        if d <= 0 {
+                return ctx.Err() == nil
+        }
+        t := time.NewTimer(d)
+        defer t.Stop()
+        select {
+        case <-ctx.Done():
+                return false
+        case <-t.C:
+                return true
+        }
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"polybalance/backend"
+	"polybalance/proxy"
+	"strings"
+	"syscall"
+)
+
+// Retry conditions for failures that never produced an upstream response
+const (
+	RetryOnConnectFailure = "connect-failure" // dial refused/failed, or the backend's circuit is open
+	RetryOnReset          = "reset"           // connection reset or closed before a response
+	RetryOnTimeout        = "timeout"         // dial, TLS or response header timeout
+)
+
+// DefaultRetryOn matches the balancer's historic behaviour: transport failures
+// plus the gateway-style statuses
+var DefaultRetryOn = []string{RetryOnConnectFailure, RetryOnReset, RetryOnTimeout, "502", "503", "504"}
+
+// RetryPolicy decides whether a failed attempt is worth repeating.
+// In a routes file it is written as:
+//
+//	"retry": {"max_retries": 3, "retry_on": ["connect-failure", "timeout", "503", "520-527"]}
+type RetryPolicy struct {
+	MaxRetries int      `json:"max_retries"`
+	RetryOn    []string `json:"retry_on"`
+
+	connectFailure bool
+	reset          bool
+	timeout        bool
+	statuses       []backend.StatusRange
+}
+
+// NewRetryPolicy builds a policy from condition names and status codes or ranges
+// ("503", "500-599"); an empty retryOn means DefaultRetryOn
+func NewRetryPolicy(maxRetries int, retryOn []string) (*RetryPolicy, error) {
+	p := &RetryPolicy{MaxRetries: maxRetries, RetryOn: retryOn}
+	if err := p.compile(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// UnmarshalJSON defaults max_retries to 2 when a routes file leaves it out
+func (p *RetryPolicy) UnmarshalJSON(data []byte) error {
+	type plain RetryPolicy
+	raw := plain{MaxRetries: 2}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*p = RetryPolicy(raw)
+	return nil
+}
+
+// defaultRetryPolicy retries twice on DefaultRetryOn
+func defaultRetryPolicy() *RetryPolicy {
+	p, _ := NewRetryPolicy(2, nil) // DefaultRetryOn always compiles
+	return p
+}
+
+func (p *RetryPolicy) compile() error {
+	if p.MaxRetries < 0 {
+		return fmt.Errorf("max_retries must not be negative")
+	}
+	if len(p.RetryOn) == 0 {
+		p.RetryOn = DefaultRetryOn
+	}
+
+	p.connectFailure, p.reset, p.timeout, p.statuses = false, false, false, nil
+	for _, cond := range p.RetryOn {
+		switch strings.TrimSpace(cond) {
+		case RetryOnConnectFailure:
+			p.connectFailure = true
+		case RetryOnReset:
+			p.reset = true
+		case RetryOnTimeout:
+			p.timeout = true
+		case "5xx":
+			p.statuses = append(p.statuses, backend.StatusRange{Min: 500, Max: 599})
+		default:
+			ranges, err := backend.ParseStatusRanges(cond)
+			if err != nil {
+				return fmt.Errorf("unknown retry condition %q", cond)
+			}
+			p.statuses = append(p.statuses, ranges...)
+		}
+	}
+	return nil
+}
+
+// allowsMethod reports whether r may be sent more than once: safe methods always,
+// anything else only with an Idempotency-Key header or on a route marked idempotent
+func (p *RetryPolicy) allowsMethod(r *http.Request, idempotentRoute bool) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return idempotentRoute || r.Header.Get("Idempotency-Key") != ""
+}
+
+// retryable decides for one attempt's outcome: upstreamErr is set when the proxy
+// failed to get a response at all, otherwise status is the backend's status code
+func (p *RetryPolicy) retryable(status int, upstreamErr error) bool {
+	if upstreamErr != nil {
+		switch classifyUpstreamError(upstreamErr) {
+		case RetryOnConnectFailure:
+			return p.connectFailure
+		case RetryOnReset:
+			return p.reset
+		case RetryOnTimeout:
+			return p.timeout
+		default:
+			return false
+		}
+	}
+	for _, sr := range p.statuses {
+		if sr.Contains(status) {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyUpstreamError maps a transport error to a retry condition, or "" when
+// it fits none (e.g. the client cancelled the request)
+func classifyUpstreamError(err error) string {
+	if errors.Is(err, context.Canceled) {
+		return ""
+	}
+	if errors.Is(err, proxy.ErrCircuitOpen) || errors.Is(err, syscall.ECONNREFUSED) {
+		return RetryOnConnectFailure
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return RetryOnTimeout
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return RetryOnConnectFailure
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return RetryOnReset
+	}
+	return ""
+}
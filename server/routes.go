@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"polybalance/backend"
+	"strings"
+)
+
+// Route matches a class of requests and restricts which backends may serve them.
+// Routes are evaluated in order; the first match wins. Requests that match no
+// route may go to any backend.
+type Route struct {
+	Name       string            `json:"name"`
+	Host       string            `json:"host"`        // exact Host match (port ignored), optional
+	PathPrefix string            `json:"path_prefix"` // optional
+	Headers    map[string]string `json:"headers"`     // all must match exactly, optional
+
+	// Selector picks the backend subset, e.g. "version=v2,zone!=us-east-1c"
+	Selector string `json:"selector"`
+
+	// Idempotent lets POST/PATCH/... on this route be retried like GET
+	Idempotent bool `json:"idempotent"`
+	// Streaming marks long-lived responses (SSE, NDJSON, long-poll) that are never
+	// retried or buffered
+	Streaming bool `json:"streaming"`
+	// Retry overrides the server's retry policy, optional
+	Retry *RetryPolicy `json:"retry"`
+	// Hedge sends slow requests to a second backend; only used for requests
+	// that may be retried (see Idempotent), optional. It is independent of
+	// Retry: a route with max_retries 0 still hedges.
+	Hedge *HedgePolicy `json:"hedge"`
+	// Timeouts override the server's timeouts field by field, optional
+	Timeouts *TimeoutPolicy `json:"timeouts"`
+
+	selector backend.Selector
+}
+
+// LoadRoutes reads a JSON array of routes from path
+func LoadRoutes(path string) ([]*Route, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []*Route
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("parsing routes file: %w", err)
+	}
+
+	for i, rt := range routes {
+		if rt.Name == "" {
+			rt.Name = fmt.Sprintf("route-%d", i)
+		}
+		if err := rt.compile(); err != nil {
+			return nil, fmt.Errorf("route %s: %w", rt.Name, err)
+		}
+	}
+	return routes, nil
+}
+
+func (rt *Route) compile() error {
+	sel, err := backend.ParseSelector(rt.Selector)
+	if err != nil {
+		return err
+	}
+	rt.selector = sel
+
+	if rt.Retry != nil {
+		if err := rt.Retry.compile(); err != nil {
+			return fmt.Errorf("retry: %w", err)
+		}
+	}
+	if rt.Hedge != nil {
+		if err := rt.Hedge.compile(); err != nil {
+			return fmt.Errorf("hedge: %w", err)
+		}
+	}
+	if rt.Timeouts != nil {
+		if err := rt.Timeouts.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the request falls under this route
+func (rt *Route) Matches(r *http.Request) bool {
+	if rt.Host != "" {
+		host := r.Host
+		if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+			host = host[:i]
+		}
+		if !strings.EqualFold(host, rt.Host) {
+			return false
+		}
+	}
+	if rt.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, rt.PathPrefix) {
+		return false
+	}
+	for k, v := range rt.Headers {
+		if r.Header.Get(k) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// matchRoute returns the first route matching r, or nil
+func (s *Server) matchRoute(r *http.Request) *Route {
+	for _, rt := range s.Routes {
+		if rt.Matches(r) {
+			return rt
+		}
+	}
+	return nil
+}
+
+// retryPolicy returns the policy for requests under rt
+func (s *Server) retryPolicy(rt *Route) *RetryPolicy {
+	if rt != nil && rt.Retry != nil {
+		return rt.Retry
+	}
+	return s.RetryPolicy
+}
+
+// candidates returns the backends a request may be sent to under its route
+func candidates(rt *Route, backends []*backend.Backend) []*backend.Backend {
+	if rt == nil {
+		return backends
+	}
+	return rt.selector.Filter(backends)
+}
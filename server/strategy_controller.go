@@ -1,8 +1,10 @@
 package server
 
 import (
+        "fmt"
         "sync"
 
+        "polybalance/events"
         "polybalance/strategy"
 )
 
@@ -48,9 +50,16 @@ func (sc *StrategyController) Set(name string) bool {
         }
 
         sc.mu.Lock()
-        defer sc.mu.Unlock()
+        previous := sc.name
         sc.current = newStrategy
         sc.name = name
+        sc.mu.Unlock()
+
+        events.Default.Publish(events.Event{
+                Type:    events.StrategyChanged,
+                Message: fmt.Sprintf("strategy changed from %s to %s", previous, name),
+                Data:    map[string]string{"from": previous, "to": name},
+        })
         return true
 }
 
@@ -0,0 +1,153 @@
+package server
+
+import (
+        "errors"
+        "fmt"
+        "log"
+        "net"
+        "net/netip"
+        "polybalance/backend"
+        "polybalance/metrics"
+        "polybalance/middleware"
+        "polybalance/proxy"
+        "polybalance/strategy"
+        "time"
+)
+
+// TCPServer balances raw TCP connections (databases, caches, ...) over the pool.
+// Each connection is pinned to one backend for its lifetime; keyed strategies
+// such as consistent hashing are keyed on the client IP.
+type TCPServer struct {
+        Pool               *backend.BackendPool
+        StrategyController *StrategyController
+
+        // DialTimeout bounds each connection attempt; MaxConnectAttempts is how many
+        // backends are tried before the client is dropped
+        DialTimeout        time.Duration
+        MaxConnectAttempts int
+
+        // IdleTimeout closes connections without traffic in either direction (0 = never)
+        IdleTimeout time.Duration
+
+        // ProxyProtocol sends a PROXY protocol header (v1 or v2) to the backend
+        // ahead of the client's bytes, so it learns the client address
+        ProxyProtocol string
+}
+
+func NewTCPServer(pool *backend.BackendPool, stratCtrl *StrategyController) (*TCPServer, error) {
+        if pool == nil {
+                return nil, fmt.Errorf("no backend pool provided")
+        }
+        return &TCPServer{
+                Pool:               pool,
+                StrategyController: stratCtrl,
+                DialTimeout:        5 * time.Second,
+                MaxConnectAttempts: 3,
+        }, nil
+}
+
+// Serve accepts connections on ln until it is closed
+func (s *TCPServer) Serve(ln net.Listener) error {
+        for {
+                conn, err := ln.Accept()
+                if err != nil {
+                        var ne net.Error
+                        if errors.As(err, &ne) && ne.Timeout() {
+                                // e.g. out of file descriptors; back off instead of spinning
+                                log.Printf("[TCP] accept error: %v", err)
+                                time.Sleep(50 * time.Millisecond)
+                                continue
+                        }
+                        return err
+                }
+                go s.handle(conn)
+        }
+}
+
+func (s *TCPServer) handle(client net.Conn) {
+        defer client.Close()
+
+        // behind a PROXY protocol listener, read the header before picking a backend:
+        // a malformed one would otherwise leave the balancer's own address as the client
+        if hs, ok := client.(interface{ Handshake() error }); ok {
+                if err := hs.Handshake(); err != nil {
+                        return
+                }
+        }
+
+        clientAddr := addrPort(client.RemoteAddr())
+        key := clientAddr.Addr().String()
+
+        b, upstream := s.connect(key)
+        if b == nil {
+                log.Printf("[TCP] no backend available for %s", client.RemoteAddr())
+                return
+        }
+        defer upstream.Close()
+
+        if s.ProxyProtocol != "" {
+                if err := middleware.WriteProxyHeader(upstream, s.ProxyProtocol, clientAddr, addrPort(client.LocalAddr())); err != nil {
+                        log.Printf("[TCP] writing PROXY header to %s: %v", b.URL, err)
+                        return
+                }
+        }
+
+        backendURL := b.URL.String()
+        metrics.TCPConnections.WithLabelValues(backendURL).Inc()
+
+        b.IncConnections()
+        start := time.Now()
+        sent, received := proxy.SpliceTCP(client, upstream, b, s.IdleTimeout)
+        b.DecConnections()
+
+        metrics.TCPBytes.WithLabelValues(backendURL, "sent").Add(float64(sent))
+        metrics.TCPBytes.WithLabelValues(backendURL, "received").Add(float64(received))
+        log.Printf("[TCP] %s -> %s closed after %v (%d bytes sent, %d received)",
+                client.RemoteAddr(), b.URL.Host, time.Since(start), sent, received)
+}
+
+// connect picks a backend and dials it, moving on to another backend when the
+// dial fails. Dial failures count against the backend's circuit breaker and the
+// dial time is its latency sample.
+func (s *TCPServer) connect(key string) (*backend.Backend, net.Conn) {
+        strat := s.StrategyController.Current()
+        backends := s.Pool.Snapshot()
+        tried := make(map[*backend.Backend]bool)
+
+        for attempt := 0; attempt < s.MaxConnectAttempts || s.MaxConnectAttempts <= 0; attempt++ {
+                b := strategy.NextBackendForKey(strat, untried(backends, tried), key)
+                if b == nil {
+                        return nil, nil
+                }
+                tried[b] = true
+
+                // circuit breaker gate, as for HTTP requests
+                if !b.CheckCircuitState() {
+                        continue
+                }
+                if b.GetCircuitState() == backend.CircuitOpen && b.CanAttemptHalfOpen() {
+                        b.SetCircuitHalfOpen()
+                }
+
+                start := time.Now()
+                conn, err := net.DialTimeout("tcp", b.URL.Host, s.DialTimeout)
+                if err != nil {
+                        log.Printf("[TCP] dial %s failed: %v", b.URL.Host, err)
+                        b.RecordFailure()
+                        metrics.BackendFailures.WithLabelValues(b.URL.String()).Inc()
+                        continue
+                }
+                b.RecordLatency(time.Since(start))
+                b.RecordSuccess()
+                return b, conn
+        }
+        return nil, nil
+}
+
+// addrPort converts a TCP address; anything else gives the zero AddrPort
+func addrPort(addr net.Addr) netip.AddrPort {
+        if tcp, ok := addr.(*net.TCPAddr); ok {
+                return tcp.AddrPort()
+        }
+        return netip.AddrPort{}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"polybalance/backend"
+	"polybalance/proxy"
+	"strconv"
+	"time"
+)
+
+// ClientTimeoutHeader lets clients ask for a shorter deadline (or, when no total timeout
+// is configured, one up to the cap), as a Go duration ("2.5s") or milliseconds ("2500").
+// gRPC clients send grpc-timeout.
+const ClientTimeoutHeader = "X-Request-Timeout"
+
+// TimeoutPolicy bounds how long a request may take. Total covers the whole exchange
+// including retries and the response body, Attempt the wait for one backend's
+// response headers, and Idle a stall in the middle of a streamed body.
+// In a routes file, fields that are left out inherit the server's values and "0" disables:
+//
+//	"timeouts": {"total": "10m", "attempt": "2m", "idle": "30s"}
+type TimeoutPolicy struct {
+	Total   string `json:"total"`
+	Attempt string `json:"attempt"`
+	Idle    string `json:"idle"`
+
+	total   time.Duration
+	attempt time.Duration
+	idle    time.Duration
+}
+
+// NewTimeoutPolicy builds a complete policy; zero durations mean no limit
+func NewTimeoutPolicy(total, attempt, idle time.Duration) *TimeoutPolicy {
+	return &TimeoutPolicy{total: total, attempt: attempt, idle: idle}
+}
+
+func (t *TimeoutPolicy) compile() error {
+	var err error
+	if t.total, err = parseRouteDuration("total", t.Total); err != nil {
+		return err
+	}
+	if t.attempt, err = parseRouteDuration("attempt", t.Attempt); err != nil {
+		return err
+	}
+	if t.idle, err = parseRouteDuration("idle", t.Idle); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseRouteDuration returns -1 for an empty value, meaning "inherit"
+func parseRouteDuration(field, v string) (time.Duration, error) {
+	if v == "" {
+		return -1, nil
+	}
+	d, err := time.ParseDuration(v)
+	if v == "0" {
+		d, err = 0, nil
+	}
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s timeout %q", field, v)
+	}
+	return d, nil
+}
+
+// timeoutsFor merges a route's timeouts over the server defaults
+func (s *Server) timeoutsFor(rt *Route) TimeoutPolicy {
+	t := TimeoutPolicy{}
+	if s.Timeouts != nil {
+		t = *s.Timeouts
+	}
+	if rt == nil || rt.Timeouts == nil {
+		return t
+	}
+	if rt.Timeouts.total >= 0 {
+		t.total = rt.Timeouts.total
+	}
+	if rt.Timeouts.attempt >= 0 {
+		t.attempt = rt.Timeouts.attempt
+	}
+	if rt.Timeouts.idle >= 0 {
+		t.idle = rt.Timeouts.idle
+	}
+	return t
+}
+
+// requestTimeout combines the configured total timeout with a deadline the client
+// asked for, which is capped at MaxClientTimeout and can only shorten the total.
+// Zero means no deadline.
+func (s *Server) requestTimeout(r *http.Request, t TimeoutPolicy) time.Duration {
+	timeout := t.total
+	client, ok := clientTimeout(r)
+	if !ok || s.MaxClientTimeout <= 0 {
+		return timeout
+	}
+	if client > s.MaxClientTimeout {
+		client = s.MaxClientTimeout
+	}
+	if timeout > 0 && timeout < client {
+		return timeout
+	}
+	return client
+}
+
+// clientTimeout reads X-Request-Timeout or grpc-timeout from the request
+func clientTimeout(r *http.Request) (time.Duration, bool) {
+	if v := r.Header.Get(ClientTimeoutHeader); v != "" {
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil && ms > 0 {
+			return time.Duration(ms) * time.Millisecond, true
+		}
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d, true
+		}
+	}
+	if v := r.Header.Get("grpc-timeout"); v != "" {
+		if d, err := proxy.ParseGRPCTimeout(v); err == nil && d > 0 {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// newProxy builds the per-attempt proxy for b with the request's timeouts applied
+func newProxy(b *backend.Backend, t TimeoutPolicy) *proxy.Proxy {
+	p := proxy.NewProxy(b)
+	p.AttemptTimeout = t.attempt
+	p.IdleTimeout = t.idle
+	return p
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+        "net/http"
+        "polybalance/backend"
+        "polybalance/metrics"
+        "polybalance/strategy"
+)
+
+// serveUpgrade proxies a protocol upgrade (WebSocket, h2c) straight to one backend.
+// The client's ResponseWriter is passed through untouched so the reverse proxy can
+// hijack it, and the backend's tunnel slot is held until the tunnel closes.
+func (s *Server) serveUpgrade(w http.ResponseWriter, r *http.Request, backends []*backend.Backend, t TimeoutPolicy) {
+        strat := s.StrategyController.Current()
+        tried := make(map[*backend.Backend]bool)
+
+        for {
+                b := strategy.NextBackendForKey(strat, untried(backends, tried), s.hashKey(r))
+                if b == nil {
+                        http.Error(w, "No backend available for upgrade", http.StatusServiceUnavailable)
+                        return
+                }
+                tried[b] = true
+
+                // a backend at its tunnel limit is skipped in favour of the next one
+                if !b.TryOpenTunnel(s.MaxTunnelsPerBackend) {
+                        continue
+                }
+
+                gauge := metrics.ActiveTunnels.WithLabelValues(b.URL.String())
+                gauge.Inc()
+
+                p := newProxy(b, t)
+                p.IdleTimeout = 0 // tunnels use TunnelIdleTimeout instead
+                p.TunnelIdleTimeout = s.TunnelIdleTimeout
+                p.ServeHTTP(w, r)
+
+                gauge.Dec()
+                b.CloseTunnel()
+                return
+        }
+}
@@ -0,0 +1,362 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"polybalance/backend"
+	"polybalance/events"
+	"sort"
+	"sync"
+	"time"
+)
+
+// stateFile is the snapshot written inside the state directory
+const stateFile = "state.json"
+
+// snapshotVersion is bumped whenever the on-disk layout changes incompatibly
+const snapshotVersion = 1
+
+// BackendState is the persisted runtime state of one backend
+type BackendState struct {
+	URL    string         `json:"url"`
+	Origin backend.Origin `json:"origin"`
+
+	// Weight is only set when an operator overrode it
+	Weight *int `json:"weight,omitempty"`
+	// Labels are only needed to recreate admin-added backends
+	Labels map[string]string `json:"labels,omitempty"`
+
+	Draining      bool       `json:"draining,omitempty"`
+	DrainDeadline *time.Time `json:"drain_deadline,omitempty"`
+
+	// Circuit is left out for discovered backends, which only keep operator overrides
+	Circuit      string     `json:"circuit,omitempty"`
+	FailureCount int64      `json:"failure_count,omitempty"`
+	LastFailure  *time.Time `json:"last_failure,omitempty"`
+}
+
+// Snapshot is the whole persisted state
+type Snapshot struct {
+	Version  int            `json:"version"`
+	SavedAt  time.Time      `json:"saved_at"`
+	Backends []BackendState `json:"backends"`
+}
+
+// Store keeps the pool's operator-relevant runtime state (circuit states, drain flags,
+// weight overrides and admin-added backends) in a JSON file so it survives restarts.
+// Backends owned by service discovery are left to the provider to rebuild; only an
+// operator's drain or weight override on them is kept, keyed by URL, and re-applied
+// by ApplySaved when discovery adds the URL again.
+type Store struct {
+	path string
+	pool *backend.BackendPool
+
+	mu        sync.Mutex
+	lastSaved []byte
+	// discovered backends' overrides waiting for their URL to be discovered again
+	pending map[string]BackendState
+}
+
+func NewStore(dir string, pool *backend.BackendPool) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating state directory: %w", err)
+	}
+	return &Store{
+		path:    filepath.Join(dir, stateFile),
+		pool:    pool,
+		pending: make(map[string]BackendState),
+	}, nil
+}
+
+// Load reads the last snapshot; a missing file yields (nil, nil)
+func (s *Store) Load() (*Snapshot, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", s.path, err)
+	}
+	if snap.Version != snapshotVersion {
+		return nil, fmt.Errorf("%s has unsupported version %d", s.path, snap.Version)
+	}
+	return &snap, nil
+}
+
+// Restore applies a snapshot to the pool. Admin-added backends are recreated with
+// newBackend; overrides for discovered backends are held until discovery adds them;
+// other state for backends that no longer exist is dropped. It should run before
+// the pool starts serving traffic and returns how many backends it touched.
+func (s *Store) Restore(snap *Snapshot, newBackend backend.Factory) int {
+	if snap == nil {
+		return 0
+	}
+
+	restored := 0
+	for _, st := range snap.Backends {
+		b := s.pool.Get(st.URL)
+		if b == nil && st.Origin == backend.OriginDiscovery {
+			s.mu.Lock()
+			s.pending[st.URL] = st
+			s.mu.Unlock()
+			restored++
+			continue
+		}
+		if b == nil {
+			if st.Origin != backend.OriginAdmin {
+				continue // config or discovery no longer lists it
+			}
+			weight := 1
+			if st.Weight != nil {
+				weight = *st.Weight
+			}
+			nb, err := newBackend(st.URL, weight)
+			if err != nil {
+				log.Printf("[state] Skipping saved backend %s: %v", st.URL, err)
+				continue
+			}
+			nb.Origin = backend.OriginAdmin
+			nb.SetLabels(st.Labels)
+			if err := s.pool.Add(nb); err != nil {
+				log.Printf("[state] Skipping saved backend %s: %v", st.URL, err)
+				continue
+			}
+			b = nb
+		}
+
+		apply(b, st)
+		restored++
+	}
+	return restored
+}
+
+// ApplySaved re-applies saved overrides to a backend discovery is about to add
+// back to the pool. It fits discovery.Reconciler's Prepare hook.
+func (s *Store) ApplySaved(b *backend.Backend) {
+	s.mu.Lock()
+	st, ok := s.pending[b.URL.String()]
+	delete(s.pending, b.URL.String())
+	s.mu.Unlock()
+
+	if ok {
+		apply(b, st)
+		log.Printf("[state] Restored saved overrides for discovered backend %s", st.URL)
+	}
+}
+
+// apply restores one backend's saved weight override, circuit and drain
+func apply(b *backend.Backend, st BackendState) {
+	if st.Weight != nil {
+		b.OverrideWeight(*st.Weight)
+	}
+
+	if st.Circuit != "" {
+		circuit, err := backend.ParseCircuitState(st.Circuit)
+		if err != nil {
+			log.Printf("[state] %s: %v", st.URL, err)
+		} else {
+			var lastFailure time.Time
+			if st.LastFailure != nil {
+				lastFailure = *st.LastFailure
+			}
+			b.RestoreCircuit(circuit, st.FailureCount, lastFailure)
+		}
+	}
+
+	if st.Draining {
+		// keep the original deadline; an expired one still leaves the backend drained
+		var timeout time.Duration
+		if st.DrainDeadline != nil {
+			timeout = time.Until(*st.DrainDeadline)
+			if timeout <= 0 {
+				timeout = time.Millisecond
+			}
+		}
+		b.StartDrain(timeout)
+	}
+}
+
+// Save writes the current pool state if it changed since the last write.
+// The file is replaced atomically so a crash never leaves a torn snapshot.
+func (s *Store) Save() error {
+	snap := s.capture()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// compare without the timestamp so an unchanged pool isn't rewritten every tick
+	body, err := json.Marshal(snap.Backends)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(body, s.lastSaved) {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return err
+	}
+	s.lastSaved = body
+	return nil
+}
+
+// Run saves on every pool event (coalesced to at most one write per interval) and
+// on a periodic tick for changes that publish no event, such as failure counts.
+// A final save happens when ctx is cancelled.
+func (s *Store) Run(ctx context.Context, bus *events.Bus, interval time.Duration) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	ch, unsubscribe := bus.Subscribe(64)
+	defer unsubscribe()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	dirty := false
+	for {
+		select {
+		case <-ctx.Done():
+			s.saveAndLog()
+			return
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !dirty {
+				// write soon after the first change, then coalesce the rest into the tick
+				dirty = true
+				s.saveAndLog()
+			}
+		case <-ticker.C:
+			dirty = false
+			s.saveAndLog()
+		}
+	}
+}
+
+func (s *Store) saveAndLog() {
+	if err := s.Save(); err != nil {
+		log.Printf("[state] Saving %s failed: %v", s.path, err)
+	}
+}
+
+// capture builds a snapshot of every backend not owned by service discovery, plus
+// operator overrides on discovered ones (including those not rediscovered yet)
+func (s *Store) capture() *Snapshot {
+	snap := &Snapshot{
+		Version:  snapshotVersion,
+		SavedAt:  time.Now(),
+		Backends: []BackendState{},
+	}
+
+	inPool := make(map[string]bool)
+	for _, b := range s.pool.Snapshot() {
+		inPool[b.URL.String()] = true
+		origin := b.Origin
+		if origin == "" {
+			origin = backend.OriginConfig
+		}
+		if origin == backend.OriginDiscovery {
+			if st, ok := captureOverrides(b); ok {
+				snap.Backends = append(snap.Backends, st)
+			}
+			continue
+		}
+
+		st := BackendState{
+			URL:    b.URL.String(),
+			Origin: origin,
+		}
+		if origin == backend.OriginAdmin || b.WeightOverridden() {
+			w := b.GetWeight()
+			st.Weight = &w
+		}
+		if origin == backend.OriginAdmin {
+			st.Labels = b.GetLabels()
+		}
+
+		drain := b.GetDrainStatus()
+		st.Draining = drain.Draining
+		st.DrainDeadline = drain.Deadline
+
+		circuit, failures, lastFailure := b.CircuitSnapshot()
+		st.Circuit = circuit.String()
+		st.FailureCount = failures
+		if !lastFailure.IsZero() {
+			st.LastFailure = &lastFailure
+		}
+
+		snap.Backends = append(snap.Backends, st)
+	}
+
+	s.mu.Lock()
+	var pending []BackendState
+	for url, st := range s.pending {
+		if !inPool[url] {
+			pending = append(pending, st)
+		}
+	}
+	s.mu.Unlock()
+	// map order would make unchanged state look different on every save
+	sort.Slice(pending, func(i, j int) bool { return pending[i].URL < pending[j].URL })
+	snap.Backends = append(snap.Backends, pending...)
+	return snap
+}
+
+// captureOverrides returns what an operator changed on a discovered backend: a
+// weight override or a drain that discovery didn't start
+func captureOverrides(b *backend.Backend) (BackendState, bool) {
+	st := BackendState{
+		URL:    b.URL.String(),
+		Origin: backend.OriginDiscovery,
+	}
+	if b.WeightOverridden() {
+		w := b.GetWeight()
+		st.Weight = &w
+	}
+	if b.IsDraining() && !b.DrainedByDiscovery() {
+		drain := b.GetDrainStatus()
+		st.Draining = true
+		st.DrainDeadline = drain.Deadline
+	}
+	return st, st.Weight != nil || st.Draining
+}
+
+// writeFileAtomic writes data to a temp file in the same directory, syncs it and renames it over path
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
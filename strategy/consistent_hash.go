@@ -9,16 +9,44 @@ import (
 	"polybalance/backend"
 	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
 )
 
 // ringEntry represents one virtual node on the hash ring
 type ringEntry struct {
-	Hash uint64
-	Idx  int // index into the original backend slice
+	Hash    uint64
+	Backend *backend.Backend
+}
+
+// maxCachedRings bounds how many backend sets (the pool, route subsets, the
+// backends left for a retry) keep a ring
+const maxCachedRings = 16
+
+// cachedRing is the ring for one set of backends
+type cachedRing struct {
+	members map[*backend.Backend]struct{}
+	ring    []ringEntry
+}
+
+// matches reports whether backends is exactly the set the ring was built from
+func (cr *cachedRing) matches(backends []*backend.Backend) bool {
+	if len(backends) != len(cr.members) {
+		return false
+	}
+	for _, b := range backends {
+		if _, ok := cr.members[b]; !ok {
+			return false
+		}
+	}
+	return true
 }
 
 type ConsistentHash struct {
-	ring         []ringEntry
+	// rings is an immutable, most recently built first list swapped on every
+	// build, so lookups don't take a lock
+	rings        atomic.Pointer[[]*cachedRing]
+	mu           sync.Mutex // serializes builds
 	virtualNodes int
 }
 
@@ -26,9 +54,9 @@ func NewConsistentHash(virtualNodes int) *ConsistentHash {
 	if virtualNodes <= 0 {
 		virtualNodes = 50
 	}
-	return &ConsistentHash{
-		virtualNodes: virtualNodes,
-	}
+	c := &ConsistentHash{virtualNodes: virtualNodes}
+	c.rings.Store(&[]*cachedRing{})
+	return c
 }
 
 // --- hashing helper ---
@@ -38,73 +66,82 @@ func hashKey(s string) uint64 {
 }
 
 // --- build the hash ring ---
-func (c *ConsistentHash) buildRing(backends []*backend.Backend) {
-	var ring []ringEntry
-
-	for i, b := range backends {
-		if !b.CheckCircuitState() {
-			continue // skip unhealthy / circuit-open backends
-		}
+// The ring holds every backend of the set, available or not; lookups skip the
+// unavailable ones, so a backend going down only moves the keys it owned.
+func (c *ConsistentHash) buildRing(backends []*backend.Backend) *cachedRing {
+	cr := &cachedRing{members: make(map[*backend.Backend]struct{}, len(backends))}
 
+	for _, b := range backends {
+		cr.members[b] = struct{}{}
 		for v := 0; v < c.virtualNodes; v++ {
-			key := b.URL.String() + "#" + strconv.Itoa(v) // FIXED: string concat
-			hash := hashKey(key)
-			ring = append(ring, ringEntry{Hash: hash, Idx: i})
+			key := b.URL.String() + "#" + strconv.Itoa(v)
+			cr.ring = append(cr.ring, ringEntry{Hash: hashKey(key), Backend: b})
 		}
 	}
 
 	// Must sort ring for binary search
-	sort.Slice(ring, func(i, j int) bool {
-		return ring[i].Hash < ring[j].Hash
+	sort.Slice(cr.ring, func(i, j int) bool {
+		return cr.ring[i].Hash < cr.ring[j].Hash
 	})
 
-	c.ring = ring
+	return cr
 }
 
-// --- Strategy Interface Implementation ---
-func (c *ConsistentHash) NextBackend(backends []*backend.Backend) *backend.Backend {
-	if len(backends) == 0 {
-		return nil
+// ringFor returns the cached ring for backends, building it on a miss
+func (c *ConsistentHash) ringFor(backends []*backend.Backend) []ringEntry {
+	for _, cr := range *c.rings.Load() {
+		if cr.matches(backends) {
+			return cr.ring
+		}
 	}
 
-	// Rebuild ring if empty or backend count changed
-	if len(c.ring) == 0 || !c.validateRing(backends) {
-		c.buildRing(backends)
-	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	if len(c.ring) == 0 {
-		return nil // no healthy backend
+	cached := *c.rings.Load()
+	for _, cr := range cached {
+		if cr.matches(backends) {
+			return cr.ring // built while we waited
+		}
+	}
+	cr := c.buildRing(backends)
+	next := append([]*cachedRing{cr}, cached...)
+	if len(next) > maxCachedRings {
+		next = next[:maxCachedRings]
 	}
+	c.rings.Store(&next)
+	return cr.ring
+}
 
-	// TODO: Replace with real request key (e.g., client IP, session cookie, JWT, user ID)
-	key := "default"
-	h := hashKey(key)
+// --- Strategy Interface Implementation ---
 
-	// Binary search on ring
-	idx := sort.Search(len(c.ring), func(i int) bool {
-		return c.ring[i].Hash >= h
-	})
+// NextBackend has no request to hash, so every call maps to the same backend;
+// callers with a client IP or session key use NextBackendForKey
+func (c *ConsistentHash) NextBackend(backends []*backend.Backend) *backend.Backend {
+	return c.NextBackendForKey(backends, "default")
+}
 
-	if idx == len(c.ring) {
-		idx = 0 // wrap around
+// NextBackendForKey maps key onto the ring, so the same key keeps its backend
+// while that backend stays available
+func (c *ConsistentHash) NextBackendForKey(backends []*backend.Backend, key string) *backend.Backend {
+	if len(backends) == 0 {
+		return nil
 	}
+	ring := c.ringFor(backends)
 
-	beIdx := c.ring[idx].Idx
-	if beIdx < 0 || beIdx >= len(backends) {
-		return nil // safety guard
-	}
+	h := hashKey(key)
 
-	return backends[beIdx]
-}
+	// Binary search on ring
+	idx := sort.Search(len(ring), func(i int) bool {
+		return ring[i].Hash >= h
+	})
 
-// Ensure ring corresponds to current backend set
-func (c *ConsistentHash) validateRing(backends []*backend.Backend) bool {
-	// Simple heuristic: if ring too small, rebuild
-	expected := 0
-	for _, b := range backends {
-		if b.CheckCircuitState() {
-			expected += c.virtualNodes
+	// walk clockwise (wrapping around) to the first backend that can take traffic
+	for i := 0; i < len(ring); i++ {
+		b := ring[(idx+i)%len(ring)].Backend
+		if b.Available() {
+			return b
 		}
 	}
-	return len(c.ring) == expected
+	return nil // no healthy backend
 }
@@ -0,0 +1,86 @@
+package strategy
+
+import (
+	"fmt"
+	"polybalance/backend"
+	"testing"
+)
+
+func testBackends(t *testing.T, n int) []*backend.Backend {
+	t.Helper()
+	var backends []*backend.Backend
+	for i := 0; i < n; i++ {
+		b, err := backend.NewBackend(fmt.Sprintf("http://10.0.0.%d:8080", i+1), 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends = append(backends, b)
+	}
+	return backends
+}
+
+func TestConsistentHashSpreadsKeys(t *testing.T) {
+	backends := testBackends(t, 4)
+	c := NewConsistentHash(50)
+
+	used := make(map[*backend.Backend]int)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		b := c.NextBackendForKey(backends, key)
+		if b != c.NextBackendForKey(backends, key) {
+			t.Fatalf("key %s mapped to two backends", key)
+		}
+		used[b]++
+	}
+	if len(used) != len(backends) {
+		t.Errorf("1000 keys landed on %d of %d backends", len(used), len(backends))
+	}
+}
+
+func TestConsistentHashBackendDown(t *testing.T) {
+	backends := testBackends(t, 4)
+	c := NewConsistentHash(50)
+
+	before := make(map[string]*backend.Backend)
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		before[key] = c.NextBackendForKey(backends, key)
+	}
+
+	down := backends[1]
+	down.SetAlive(false)
+	for key, was := range before {
+		got := c.NextBackendForKey(backends, key)
+		switch {
+		case got == down:
+			t.Fatalf("key %s still maps to the unavailable backend", key)
+		case was != down && got != was:
+			t.Errorf("key %s moved from %s to %s although its backend is up", key, was.URL, got.URL)
+		}
+	}
+
+	for _, b := range backends {
+		b.SetAlive(false)
+	}
+	if b := c.NextBackendForKey(backends, "client-1"); b != nil {
+		t.Errorf("got %s with every backend down, want nil", b.URL)
+	}
+}
+
+func TestConsistentHashCachesRings(t *testing.T) {
+	backends := testBackends(t, 3)
+	c := NewConsistentHash(10)
+
+	first := c.ringFor(backends)
+	reordered := []*backend.Backend{backends[2], backends[0], backends[1]}
+	if got := c.ringFor(reordered); &got[0] != &first[0] {
+		t.Error("the same backend set built a second ring")
+	}
+	subset := c.ringFor(backends[:2])
+	if len(subset) != 2*10 {
+		t.Errorf("subset ring has %d entries, want 20", len(subset))
+	}
+	if got := c.ringFor(backends); &got[0] != &first[0] {
+		t.Error("the first ring was lost after building another")
+	}
+}
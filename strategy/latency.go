@@ -24,8 +24,8 @@ func (l *LatencyStrategy) NextBackend(backends []*backend.Backend) *backend.Back
 
 	for _, b := range backends {
 		// b is a pointer to backend.Backend
-		if !b.CheckCircuitState() {
-			continue // skip unhealthy / circuit-open backends
+		if !b.Available() {
+			continue // skip unhealthy / circuit-open / draining backends
 		}
 		latency := b.GetAverageLatency()
 
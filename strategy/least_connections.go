@@ -18,8 +18,8 @@ func (lc *LeastConnections) NextBackend(backends []*backend.Backend) *backend.Ba
 	var minConnections int64 = -1 // initialize to -1 to indicate no backend selected yet
 
 	for _, b := range backends {
-		if !b.CheckCircuitState() {
-			continue // skip unhealthy / circuit-open backends
+		if !b.Available() {
+			continue // skip unhealthy / circuit-open / draining backends
 		}
 
 		active := b.GetActiveConnections()
@@ -27,7 +27,7 @@ func (rr *RoundRobin) NextBackend(backends []*backend.Backend) *backend.Backend
 		idx := atomic.AddUint64(&rr.counter, 1) % uint64(n)
 		b := backends[idx]
 
-		if b.CheckCircuitState() {
+		if b.Available() {
 			return b
 		}
 	}
@@ -7,3 +7,18 @@ import "polybalance/backend"
 type Strategy interface {
 	NextBackend(backends []*backend.Backend) *backend.Backend
 }
+
+// KeyedStrategy is implemented by strategies that map a key (client IP,
+// session, ...) to the same backend every time
+type KeyedStrategy interface {
+	Strategy
+	NextBackendForKey(backends []*backend.Backend, key string) *backend.Backend
+}
+
+// NextBackendForKey picks by key when s supports it, and falls back to s.NextBackend
+func NextBackendForKey(s Strategy, backends []*backend.Backend, key string) *backend.Backend {
+	if ks, ok := s.(KeyedStrategy); ok {
+		return ks.NextBackendForKey(backends, key)
+	}
+	return s.NextBackend(backends)
+}
@@ -5,6 +5,7 @@ import (
         "html/template"
         "net/http"
         "polybalance/backend"
+        "polybalance/events"
         "polybalance/middleware"
         "polybalance/server"
         "strconv"
@@ -12,7 +13,7 @@ import (
 )
 
 type Dashboard struct {
-        backends           []*backend.Backend
+        pool               *backend.BackendPool
         rateLimiter        *middleware.RateLimiter
         requestLimiter     *middleware.RequestLimiter
         tlsConfig          *middleware.TLSConfig
@@ -22,9 +23,9 @@ type Dashboard struct {
         errorCount         int64
 }
 
-func NewDashboard(backends []*backend.Backend, rl *middleware.RateLimiter, reqLim *middleware.RequestLimiter, tlsCfg *middleware.TLSConfig, stratCtrl *server.StrategyController) *Dashboard {
+func NewDashboard(pool *backend.BackendPool, rl *middleware.RateLimiter, reqLim *middleware.RequestLimiter, tlsCfg *middleware.TLSConfig, stratCtrl *server.StrategyController) *Dashboard {
         return &Dashboard{
-                backends:           backends,
+                pool:               pool,
                 rateLimiter:        rl,
                 requestLimiter:     reqLim,
                 tlsConfig:          tlsCfg,
@@ -33,9 +34,26 @@ func NewDashboard(backends []*backend.Backend, rl *middleware.RateLimiter, reqLi
         }
 }
 
+// RegisterRoutes serves the dashboard on the public listener, without the event
+// stream: events carry backend and config details, and their paths would shadow
+// the proxied application's
 func (d *Dashboard) RegisterRoutes(mux *http.ServeMux) {
-        mux.HandleFunc("/ui", d.handleDashboard)
-        mux.HandleFunc("/ui/", d.handleDashboard)
+        d.register(mux, false)
+}
+
+// RegisterAdminRoutes serves the dashboard with its live event stream on the admin listener
+func (d *Dashboard) RegisterAdminRoutes(mux *http.ServeMux) {
+        d.register(mux, true)
+        mux.Handle("/api/events", events.SSEHandler(events.Default))
+        mux.HandleFunc("/api/events/recent", d.handleRecentEvents)
+}
+
+func (d *Dashboard) register(mux *http.ServeMux, withEvents bool) {
+        page := func(w http.ResponseWriter, r *http.Request) {
+                d.handleDashboard(w, r, withEvents)
+        }
+        mux.HandleFunc("/ui", page)
+        mux.HandleFunc("/ui/", page)
         mux.HandleFunc("/api/status", d.handleStatus)
         mux.HandleFunc("/api/backends", d.handleBackends)
         mux.HandleFunc("/api/backends/toggle", d.handleToggleBackend)
@@ -45,20 +63,24 @@ func (d *Dashboard) RegisterRoutes(mux *http.ServeMux) {
         mux.HandleFunc("/api/strategy", d.handleStrategy)
 }
 
-func (d *Dashboard) handleDashboard(w http.ResponseWriter, r *http.Request) {
+func (d *Dashboard) handleDashboard(w http.ResponseWriter, r *http.Request, withEvents bool) {
         w.Header().Set("Content-Type", "text/html; charset=utf-8")
         w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 
         tmpl := template.Must(template.New("dashboard").Parse(dashboardHTML))
-        tmpl.Execute(w, nil)
+        tmpl.Execute(w, struct {
+                EventTypes []events.Type
+                Events     bool
+        }{events.Types, withEvents})
 }
 
 func (d *Dashboard) handleStatus(w http.ResponseWriter, r *http.Request) {
         w.Header().Set("Content-Type", "application/json")
         w.Header().Set("Cache-Control", "no-cache")
 
+        backendList := d.pool.Snapshot()
         healthyCount := 0
-        for _, b := range d.backends {
+        for _, b := range backendList {
                 if b.IsAlive() {
                         healthyCount++
                 }
@@ -68,7 +90,7 @@ func (d *Dashboard) handleStatus(w http.ResponseWriter, r *http.Request) {
                 "uptime_seconds":   int(time.Since(d.startTime).Seconds()),
                 "strategy":         d.strategyController.Name(),
                 "strategies":       d.strategyController.AvailableStrategies(),
-                "total_backends":   len(d.backends),
+                "total_backends":   len(backendList),
                 "healthy_backends": healthyCount,
                 "rate_limit":       d.rateLimiter.GetStats(),
                 "request_limit":    d.requestLimiter.GetStats(),
@@ -82,13 +104,16 @@ func (d *Dashboard) handleBackends(w http.ResponseWriter, r *http.Request) {
         w.Header().Set("Content-Type", "application/json")
         w.Header().Set("Cache-Control", "no-cache")
 
-        backends := make([]map[string]interface{}, 0, len(d.backends))
-        for i, b := range d.backends {
+        snapshot := d.pool.Snapshot()
+        backends := make([]map[string]interface{}, 0, len(snapshot))
+        for i, b := range snapshot {
                 backends = append(backends, map[string]interface{}{
                         "id":          i,
                         "url":         b.URL.String(),
                         "healthy":     b.IsAlive(),
-                        "weight":      b.Weight,
+                        "draining":    b.IsDraining(),
+                        "weight":      b.GetWeight(),
+                        "labels":      b.GetLabels(),
                         "connections": b.GetActiveConnections(),
                 })
         }
@@ -226,6 +251,16 @@ func (d *Dashboard) handleConfig(w http.ResponseWriter, r *http.Request) {
                         }
                 }
 
+                changed := make(map[string]string)
+                for key := range r.PostForm {
+                        changed[key] = r.PostForm.Get(key)
+                }
+                events.Default.Publish(events.Event{
+                        Type:    events.ConfigChanged,
+                        Message: "configuration updated from dashboard",
+                        Data:    changed,
+                })
+
                 w.Header().Set("Content-Type", "application/json")
                 w.Write([]byte(`{"status": "ok"}`))
                 return
@@ -280,6 +315,12 @@ func (d *Dashboard) handleStrategy(w http.ResponseWriter, r *http.Request) {
         })
 }
 
+func (d *Dashboard) handleRecentEvents(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Cache-Control", "no-cache")
+        json.NewEncoder(w).Encode(events.Default.Recent())
+}
+
 func (d *Dashboard) handleTest(w http.ResponseWriter, r *http.Request) {
         w.Header().Set("Content-Type", "application/json")
 
@@ -293,7 +334,7 @@ func (d *Dashboard) handleTest(w http.ResponseWriter, r *http.Request) {
         case "health":
                 healthy := 0
                 unhealthy := 0
-                for _, b := range d.backends {
+                for _, b := range d.pool.Snapshot() {
                         if b.IsAlive() {
                                 healthy++
                         } else {
@@ -320,7 +361,7 @@ func (d *Dashboard) handleTest(w http.ResponseWriter, r *http.Request) {
                 result["status"] = "ok"
 
         case "connection":
-                for _, b := range d.backends {
+                for _, b := range d.pool.Snapshot() {
                         if b.IsAlive() {
                                 result["status"] = "ok"
                                 result["message"] = "At least one backend is healthy"
@@ -431,6 +472,17 @@ const dashboardHTML = `<!DOCTYPE html>
         }
         .badge.healthy { background: #d4edda; color: #155724; }
         .badge.unhealthy { background: #f8d7da; color: #721c24; }
+        .badge.draining { background: #fff3cd; color: #856404; }
+        .label-chip {
+            display: inline-block;
+            margin-left: 6px;
+            padding: 2px 6px;
+            border-radius: 4px;
+            background: #e8f4fb;
+            color: #2C3E50;
+            font-family: 'Roboto Mono', monospace;
+            font-size: 0.7rem;
+        }
         .controls { display: flex; flex-direction: column; gap: 14px; }
         .control-group label { display: block; margin-bottom: 6px; font-size: 0.85rem; color: #7f8c8d; font-weight: 500; }
         .control-row { display: flex; gap: 10px; align-items: center; }
@@ -630,6 +682,11 @@ const dashboardHTML = `<!DOCTYPE html>
                 </div>
             </div>
 
+            <div class="card" style="grid-column: 1 / -1;">
+                <h2>Events</h2>
+                <div class="test-output" id="event-output">Waiting for events...</div>
+            </div>
+
             <div class="card" style="grid-column: 1 / -1;">
                 <h2>Load Balancer Testing</h2>
                 <div class="request-tester">
@@ -704,11 +761,19 @@ const dashboardHTML = `<!DOCTYPE html>
                 const container = document.getElementById('backends');
                 container.innerHTML = backends.map(b => 
                     '<div class="backend-item">' +
-                    '<span class="backend-url">' + b.url + '</span>' +
+                    '<div><span class="backend-url">' + b.url + '</span>' +
+                    Object.entries(b.labels || {}).map(([k, v]) =>
+                        '<span class="label-chip">' + k + '=' + v + '</span>').join('') +
+                    '</div>' +
                     '<div style="display:flex;align-items:center;gap:8px;">' +
                     '<span class="badge ' + (b.healthy ? 'healthy' : 'unhealthy') + '">' + 
                     (b.healthy ? 'Healthy' : 'Unhealthy') + '</span>' +
+                    (b.draining ? '<span class="badge draining">Draining</span>' : '') +
                     '<span style="color:#7f8c8d;font-size:0.75rem">(' + b.connections + ' conn)</span>' +
+                    '<button class="btn btn-secondary" ' +
+                    'onclick="toggleDrain(\'' + b.url + '\', ' + b.draining + ')" ' +
+                    'style="padding:5px 10px;font-size:0.7rem;">' +
+                    (b.draining ? 'Undrain' : 'Drain') + '</button>' +
                     '<button class="btn ' + (b.healthy ? 'btn-danger' : 'btn-success') + '" ' +
                     'onclick="toggleBackendHealth(\'' + b.url + '\')" ' +
                     'style="padding:5px 10px;font-size:0.7rem;">' +
@@ -740,6 +805,27 @@ const dashboardHTML = `<!DOCTYPE html>
             }
         }
 
+        async function toggleDrain(url, draining) {
+            try {
+                log((draining ? 'Undraining ' : 'Draining ') + url + '...', 'info');
+                const res = await fetch('/api/admin/backends/drain?url=' + encodeURIComponent(url),
+                    { method: draining ? 'DELETE' : 'POST' });
+                if (res.status === 404) {
+                    log('Drain failed: the admin API is only served on LB_ADMIN_ADDR', 'error');
+                    return;
+                }
+                const data = await res.json();
+                if (data.status === 'ok') {
+                    log(url + ': draining=' + data.drain.draining + ', active connections=' + data.drain.active_connections, 'success');
+                } else {
+                    log('Drain failed: ' + data.message, 'error');
+                }
+                fetchBackends();
+            } catch (e) {
+                log('Drain failed: ' + e.message, 'error');
+            }
+        }
+
         async function sendTestRequests() {
             const count = parseInt(document.getElementById('request-count').value) || 10;
             const strategy = document.getElementById('strategy').value;
@@ -883,6 +969,48 @@ const dashboardHTML = `<!DOCTYPE html>
             }
         }
 
+        function showEvent(e) {
+            const output = document.getElementById('event-output');
+            if (output.dataset.started !== 'true') {
+                output.innerHTML = '';
+                output.dataset.started = 'true';
+            }
+            const type = e.type.includes('opened') || e.type.includes('unhealthy') ? 'error'
+                : (e.type.includes('closed') || e.type.includes('healthy') ? 'success' : 'info');
+            const entry = document.createElement('div');
+            entry.className = 'log-entry ' + type;
+            entry.textContent = '[' + new Date(e.time).toLocaleTimeString() + '] ' + e.type +
+                (e.backend ? ' ' + e.backend : '') + ': ' + e.message;
+            output.insertBefore(entry, output.firstChild);
+        }
+
+        async function subscribeEvents() {
+            let lastId = 0;
+            const show = e => {
+                if (e.id <= lastId) return;
+                lastId = e.id;
+                showEvent(e);
+            };
+            try {
+                const res = await fetch('/api/events/recent');
+                const recent = await res.json();
+                recent.forEach(show);
+            } catch (e) {
+                log('Failed to fetch events: ' + e.message, 'error');
+            }
+            // resume after the last event fetched so nothing published in between is lost
+            const source = new EventSource('/api/events?last_event_id=' + lastId);
+            // every type the server publishes, from events.Types
+            const eventTypes = {{.EventTypes}};
+            eventTypes.forEach(t => {
+                source.addEventListener(t, ev => {
+                    show(JSON.parse(ev.data));
+                    fetchBackends();
+                    fetchStatus();
+                });
+            });
+        }
+
         function refreshAll() {
             fetchStatus();
             fetchBackends();
@@ -891,6 +1019,8 @@ const dashboardHTML = `<!DOCTYPE html>
 
         fetchStatus();
         fetchBackends();
+        {{if .Events}}subscribeEvents();{{else}}document.getElementById('event-output').textContent =
+            'Live events are only served on LB_ADMIN_ADDR';{{end}}
         setInterval(fetchStatus, 5000);
         setInterval(fetchBackends, 5000);
     </script>